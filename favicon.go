@@ -0,0 +1,170 @@
+package ffimage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// FaviconOptions is the options for FaviconSet.
+type FaviconOptions struct {
+	// Sizes is the sizes of the icons in the .ico from 1 to 256, 16, 32, 48, 64 and 256 are used if it's empty.
+	Sizes []int
+	// AppleTouchIcon writes "apple-touch-icon.png" (180x180) to the same directory of the .ico, the transparent area is filled with the matte color (or the background color if it was not set) since iOS fills it with black.
+	AppleTouchIcon bool
+	// Manifest writes "icon-192.png" and "icon-512.png" to the same directory of the .ico for the web manifest.
+	Manifest bool
+}
+
+// Favicon is a single icon rendered by FaviconSet.
+type Favicon struct {
+	Path string `json:"src"`
+	// Sizes is the size in the web manifest format (e.g. "192x192").
+	Sizes string `json:"sizes"`
+	Type  string `json:"type"`
+}
+
+// FaviconBundle is the result of FaviconSet.
+type FaviconBundle struct {
+	// Path is the path of the multi-resolution .ico.
+	Path string
+	// Sizes is the sizes of the icons in the .ico.
+	Sizes []int
+	// AppleTouchIcon is the path of the apple touch icon, empty if it wasn't requested.
+	AppleTouchIcon string
+	// Icons is the PNG icons for the web manifest, empty if it wasn't requested.
+	Icons []*Favicon
+}
+
+// FaviconSet renders the image (with the applied operations) to a multi-resolution .ico (16, 32, 48, 64 and 256 as default) and writes it to the path. Non-square images are centered on a transparent square. The apple touch icon and the PNG icons for the web manifest are written to the same directory if requested.
+func (i *Image) FaviconSet(path string, opts ...FaviconOptions) (*FaviconBundle, error) {
+	if i.err != nil {
+		return nil, i.err
+	}
+	var opt FaviconOptions
+	if len(opts) == 1 {
+		opt = opts[0]
+	}
+	sizes := opt.Sizes
+	if len(sizes) == 0 {
+		sizes = []int{16, 32, 48, 64, 256}
+	}
+	bundle := &FaviconBundle{Path: path}
+
+	icons := make([][]byte, 0, len(sizes))
+	for _, v := range sizes {
+		if v < 1 || v > 256 {
+			return nil, fmt.Errorf("invalid icon size: %d", v)
+		}
+		b, err := i.renderIcon(v, false)
+		if err != nil {
+			return nil, fmt.Errorf("render icon: %w", err)
+		}
+		icons = append(icons, b)
+		bundle.Sizes = append(bundle.Sizes, v)
+	}
+	if err := os.WriteFile(path, encodeICO(bundle.Sizes, icons), 0644); err != nil {
+		return nil, fmt.Errorf("write: %w", err)
+	}
+
+	dir := filepath.Dir(path)
+	if opt.AppleTouchIcon {
+		bundle.AppleTouchIcon = filepath.Join(dir, "apple-touch-icon.png")
+		if err := i.writeIcon(bundle.AppleTouchIcon, 180, true); err != nil {
+			return nil, err
+		}
+	}
+	if opt.Manifest {
+		for _, v := range []int{192, 512} {
+			icon := &Favicon{
+				Path:  filepath.Join(dir, fmt.Sprintf("icon-%d.png", v)),
+				Sizes: fmt.Sprintf("%dx%d", v, v),
+				Type:  "image/png",
+			}
+			if err := i.writeIcon(icon.Path, v, false); err != nil {
+				return nil, err
+			}
+			bundle.Icons = append(bundle.Icons, icon)
+		}
+	}
+
+	if i.isTemp {
+		if err := os.Remove(i.Path); err != nil {
+			return nil, fmt.Errorf("remove: %w", err)
+		}
+	}
+	return bundle, nil
+}
+
+// Manifest returns the "icons" snippet of the web manifest, the paths are relative to the given base URL (e.g. "/").
+func (b *FaviconBundle) Manifest(baseURL string) ([]byte, error) {
+	icons := make([]Favicon, 0, len(b.Icons))
+	for _, v := range b.Icons {
+		icon := *v
+		icon.Path = baseURL + filepath.Base(v.Path)
+		icons = append(icons, icon)
+	}
+	return json.MarshalIndent(map[string]any{"icons": icons}, "", "  ")
+}
+
+// writeIcon renders the image as a square PNG of the size and writes it to the path.
+func (i *Image) writeIcon(path string, size int, isOpaque bool) error {
+	b, err := i.renderIcon(size, isOpaque)
+	if err != nil {
+		return fmt.Errorf("render icon: %w", err)
+	}
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	return nil
+}
+
+// renderIcon renders the first frame of the image as a square PNG of the size, the image is fitted and centered on the transparent (or matte color if isOpaque) square.
+func (i *Image) renderIcon(size int, isOpaque bool) ([]byte, error) {
+	w, h := i.calcBestpad(i.Width, i.Height, size, size)
+	w, h = max(1, w), max(1, h)
+
+	input := i.buildFilters(i.input()).
+		Filter("scale", ffmpeg.Args{fmt.Sprintf("%d:%d:flags=lanczos", w, h)}).
+		Filter("format", ffmpeg.Args{"rgba"}).
+		Filter("pad", ffmpeg.Args{fmt.Sprintf("%d:%d:%d:%d:black@0", size, size, (size-w)/2, (size-h)/2)})
+	if isOpaque {
+		input = flatten(input, i.matteColor()).Filter("format", ffmpeg.Args{"rgb24"})
+	}
+
+	buf, errBuf := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+	err := input.
+		Output("pipe:", ffmpeg.KwArgs{"frames:v": 1, "f": "image2pipe", "c:v": "png"}).
+		Silent(i.Silent).WithInput(i.stdin()).WithOutput(buf).WithErrorOutput(errBuf).Run()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg output: %s", errBuf.String())
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeICO packs the PNG icons into an .ico file, the PNG icons are stored as is which is supported since Windows Vista and by all the browsers.
+func encodeICO(sizes []int, icons [][]byte) []byte {
+	buf := bytes.NewBuffer(nil)
+	// ICONDIR: reserved, type (1 for icon), count.
+	binary.Write(buf, binary.LittleEndian, [3]uint16{0, 1, uint16(len(icons))})
+
+	offset := 6 + 16*len(icons)
+	for k, v := range icons {
+		// The size 256 is stored as 0.
+		size := uint8(sizes[k] % 256)
+		// ICONDIRENTRY: width, height, colors, reserved, planes, bits per pixel, data size, data offset.
+		buf.Write([]byte{size, size, 0, 0})
+		binary.Write(buf, binary.LittleEndian, [2]uint16{1, 32})
+		binary.Write(buf, binary.LittleEndian, [2]uint32{uint32(len(v)), uint32(offset)})
+		offset += len(v)
+	}
+	for _, v := range icons {
+		buf.Write(v)
+	}
+	return buf.Bytes()
+}
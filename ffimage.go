@@ -1,10 +1,14 @@
 package ffimage
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"math"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/gabriel-vasile/mimetype"
 	ffmpeg "github.com/u2takey/ffmpeg-go"
@@ -24,6 +28,14 @@ const (
 	ImageFormatAPNG    = "apng"
 	ImageFormatBMP     = "bmp"
 	ImageFormatGIF     = "gif"
+	ImageFormatTIFF    = "tiff"
+	ImageFormatTGA     = "tga"
+	ImageFormatPPM     = "ppm"
+	ImageFormatPAM     = "pam"
+	ImageFormatQOI     = "qoi"
+	ImageFormatICO     = "ico"
+	ImageFormatMP4     = "mp4"
+	ImageFormatWebM    = "webm"
 )
 
 // ResizeType
@@ -51,14 +63,47 @@ const (
 	PositionTypeBottomRight PositionType = "bottom_right"
 )
 
+// FrameType
+type FrameType int
+
+const (
+	FrameTypeOuter FrameType = iota
+	FrameTypeInner
+)
+
+// RedactMode
+type RedactMode int
+
+const (
+	RedactModePixelate RedactMode = iota
+	RedactModeBlur
+	RedactModeFill
+)
+
+// Rect
+type Rect struct {
+	X      int
+	Y      int
+	Width  int
+	Height int
+}
+
 // Name   Worse  Best  Default  Usage
 // JPEG    31     2      17   -qscale:v
 // WEBP    0     100     75   -quality
-// JPXL    0     100     90   -qscale:v
+// JPXL    25    0       1    -distance
 // AVIF    63     0      50   -crf
 // PNG     -      -      -
 // BMP     -      -      -
 // GIF     -      -      -
+// TIFF    -      -      -
+// TGA     -      -      -
+// PPM     -      -      -
+// PAM     -      -      -
+// QOI     -      -      -
+// ICO     -      -      -
+// MP4     51     17     23   -crf
+// WEBM    63     0      31   -crf
 
 // Image
 type Image struct {
@@ -69,6 +114,16 @@ type Image struct {
 	Output *Output
 	Silent bool
 	isTemp bool
+	err    error
+	// inputArgs is the arguments for reading the source (e.g. raw pixels from NewImageFromGoImage).
+	inputArgs ffmpeg.KwArgs
+	// pixels is the raw RGBA from NewImageFromGoImage, which is piped to the stdin of ffmpeg instead of a temp file.
+	pixels   []byte
+	tileGrid *tileGrid
+	// seek is the time of the frame to be read from the video, it's separated from inputArgs since ffprobe doesn't support it.
+	seek time.Duration
+	// streamLoop is the extra plays of the source for the finite loop of the videos, it's set by WriteImage.
+	streamLoop int
 }
 
 type Output struct {
@@ -81,15 +136,34 @@ type Output struct {
 	DropFrames      bool
 	Framerate       bool
 	IsPreserved     bool
+	IsTransparent   bool
 	EXIF            string
 	Codec           string
 	BackgroundColor string
+	MatteColor      string
+	Levels          *Levels
+	JXL             *JXLOptions
+	TIFF            *TIFFOptions
+	WebP            *WebPOptions
+	AVIF            *AVIFOptions
+	JPEG            *JPEGOptions
+	PNG             *PNGOptions
+	GIF             *GIFOptions
+	// Optimizer is the tool which optimized the PNG or GIF output after SetQuality, can be read after WriteImage.
+	Optimizer Optimizer
 }
 
 // NewImage
 func NewImage(path string) (*Image, error) {
+	return newImageWithInput(path, nil, nil)
+}
+
+// newImageWithInput creates the image with the arguments for reading the source, the pixels are piped to ffmpeg as the source if it's not nil.
+func newImageWithInput(path string, inputArgs ffmpeg.KwArgs, pixels []byte) (*Image, error) {
 	image := &Image{
-		Path: path,
+		Path:      path,
+		inputArgs: inputArgs,
+		pixels:    pixels,
 		Output: &Output{
 			BackgroundColor: "black",
 			Args:            make([]ffmpeg.KwArgs, 0),
@@ -128,27 +202,113 @@ func NewImageFromBytes(data []byte) (*Image, error) {
 
 // loadImageSize
 func (i *Image) loadImageSize() error {
-	data, err := ffprobe.ProbeURL(context.TODO(), i.Path)
+	var data *ffprobe.ProbeData
+	var err error
+	if i.pixels != nil {
+		data, err = ffprobe.ProbeReader(context.TODO(), bytes.NewReader(i.pixels), ffmpeg.ConvertKwargsToCmdLineArgs(i.inputArgs)...)
+	} else {
+		data, err = ffprobe.ProbeURL(context.TODO(), i.Path, ffmpeg.ConvertKwargsToCmdLineArgs(i.inputArgs)...)
+	}
 	if err != nil {
 		return fmt.Errorf("probe url: %w", err)
 	}
-	if len(data.Streams) == 0 || data.Streams[0].Width == 0 || data.Streams[0].Height == 0 || data.Streams[0] == nil {
+	// The first stream might be the audio or the cover art of the video.
+	i.Stream = videoStream(data.Streams)
+	if i.Stream == nil {
 		return fmt.Errorf("no valid stream found")
 	}
-	i.Stream = data.Streams[0]
+	i.Output.IsTransparent = hasAlpha(i.Stream.PixFmt)
+	// HEIC (e.g. from iPhone) stores the photo as multiple tiles, use the size of the stitched image.
+	// The error is ignored since ffprobe before 7.1 doesn't support stream groups.
+	if len(data.Streams) > 1 && isHEIF(data.Format) {
+		if grid, err := probeTileGrid(i.Path); err == nil && grid != nil {
+			i.tileGrid = grid
+			i.Stream.Width, i.Stream.Height = grid.size()
+		}
+	}
 	i.setWidthHeight(i.Stream.Width, i.Stream.Height)
 	return nil
 }
 
+// videoStream returns the first video stream which isn't an attached picture (e.g. cover art), returns nil if there's no such stream.
+func videoStream(streams []*ffprobe.Stream) *ffprobe.Stream {
+	for _, v := range streams {
+		if v == nil || v.CodecType != "video" || v.Disposition.AttachedPic == 1 || v.Width == 0 || v.Height == 0 {
+			continue
+		}
+		return v
+	}
+	return nil
+}
+
+// isHEIF reports whether the container is HEIF (e.g. HEIC, AVIF) by the brands, which might store the image as a tile grid.
+func isHEIF(format *ffprobe.Format) bool {
+	if format == nil {
+		return false
+	}
+	major, _ := format.TagList.GetString("major_brand")
+	compatible, _ := format.TagList.GetString("compatible_brands")
+	for _, v := range []string{"mif1", "msf1", "heic", "heix", "avif", "avis"} {
+		if major == v || strings.Contains(compatible, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// input
+func (i *Image) input() *ffmpeg.Stream {
+	args := i.inputArgs
+	if i.seek > 0 || i.streamLoop > 0 {
+		args = ffmpeg.KwArgs{}
+		for k, v := range i.inputArgs {
+			args[k] = v
+		}
+		if i.seek > 0 {
+			args["ss"] = fmt.Sprintf("%.3f", i.seek.Seconds())
+		}
+		if i.streamLoop > 0 {
+			args["stream_loop"] = i.streamLoop
+		}
+	}
+	input := ffmpeg.Input(i.Path, args)
+	if i.tileGrid != nil {
+		return i.tileGrid.build(input)
+	}
+	return input
+}
+
+// stdin returns the reader of the pixels for the stdin of ffmpeg, returns nil if the source is a file.
+func (i *Image) stdin() io.Reader {
+	if i.pixels == nil {
+		return nil
+	}
+	return bytes.NewReader(i.pixels)
+}
+
 // filter
 type filter struct {
-	k    string
-	args ffmpeg.Args
+	k     string
+	args  ffmpeg.Args
+	graph func(*ffmpeg.Stream) *ffmpeg.Stream
 }
 
 // addFilter
 func (i *Image) addFilter(k string, args ffmpeg.Args) {
-	i.Output.Filters = append(i.Output.Filters, &filter{k, args})
+	i.Output.Filters = append(i.Output.Filters, &filter{k: k, args: args})
+}
+
+// addGraph adds a step which takes the current stream and returns the processed stream, for the filters that require split or multiple inputs.
+func (i *Image) addGraph(fn func(*ffmpeg.Stream) *ffmpeg.Stream) {
+	i.Output.Filters = append(i.Output.Filters, &filter{graph: fn})
+}
+
+// keepAlpha applies the filter to the color of the stream only and merges the original alpha back, for the filters that drop the alpha channel (e.g. eq).
+func keepAlpha(s *ffmpeg.Stream, k string, args ffmpeg.Args) *ffmpeg.Stream {
+	split := s.Split()
+	color, alpha := split.Get("0").Filter(k, args), split.Get("1").Filter("alphaextract", ffmpeg.Args{})
+
+	return ffmpeg.Filter([]*ffmpeg.Stream{color, alpha}, "alphamerge", ffmpeg.Args{})
 }
 
 // addArg
@@ -156,12 +316,29 @@ func (i *Image) addArg(args ffmpeg.KwArgs) {
 	i.Output.Args = append(i.Output.Args, args)
 }
 
+// escapeFilterValue escapes the value (e.g. file path) which is passed as a filter option.
+func escapeFilterValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `:`, `\:`, `'`, `\'`).Replace(v)
+}
+
 // setWidthHeight
 func (i *Image) setWidthHeight(w, h int) {
 	i.Width = w
 	i.Height = h
 }
 
+// jxlDistance converts the quality to the distance of JPEG XL with the same formula as cjxl, 100 means lossless.
+func jxlDistance(quality int) float64 {
+	q := float64(quality)
+	switch {
+	case quality >= 100:
+		return 0
+	case quality >= 30:
+		return 0.1 + (100-q)*0.09
+	}
+	return 53.0/3000.0*q*q - 23.0/20.0*q + 25
+}
+
 // qualityFactor
 func qualityFactor(min, max int, quality int, isLowerBetter bool) int {
 	if isLowerBetter {
@@ -170,6 +347,53 @@ func qualityFactor(min, max int, quality int, isLowerBetter bool) int {
 	return min + int((float64(quality)/100)*float64(max-min))
 }
 
+// hasAlpha reports whether the pixel format might contain transparency, palette formats are included since GIF and PNG can have a transparent color.
+func hasAlpha(pixFmt string) bool {
+	for _, v := range []string{"rgba", "bgra", "argb", "abgr", "yuva", "gbrap", "ya8", "ya16", "pal8"} {
+		if strings.HasPrefix(pixFmt, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// matteColor returns the color for flattening the transparent image, the background color will be used if the matte color wasn't setted.
+func (i *Image) matteColor() string {
+	if i.Output.MatteColor != "" {
+		return i.Output.MatteColor
+	}
+	return i.Output.BackgroundColor
+}
+
+// flatten composites the stream onto the solid color.
+func flatten(s *ffmpeg.Stream, color string) *ffmpeg.Stream {
+	split := s.Split()
+	bg := split.Get("0").
+		Filter("format", ffmpeg.Args{"yuv444p"}).
+		Filter("drawbox", ffmpeg.Args{fmt.Sprintf("c=%s@1:t=fill", opaqueColor(color))})
+
+	return ffmpeg.Filter([]*ffmpeg.Stream{bg, split.Get("1")}, "overlay", ffmpeg.Args{"format=auto"})
+}
+
+// opaqueColor removes the alpha from the color (e.g. "#00000000", "black@0.5") so it can be used as a solid background. The color names (e.g. "lavender") are kept as is even if they have 8 characters.
+func opaqueColor(color string) string {
+	color, _, _ = strings.Cut(color, "@")
+	if v := strings.TrimPrefix(strings.TrimPrefix(color, "#"), "0x"); len(v) == 8 && isHex(v) {
+		color = strings.TrimSuffix(color, v[6:])
+	}
+	return color
+}
+
+// isHex reports whether the string only contains hex digits.
+func isHex(s string) bool {
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
 // calcPosition
 func (i *Image) calcPosition(origW, origH, w, h int, pos PositionType) (x int, y int) {
 	switch pos {
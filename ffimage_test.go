@@ -1,12 +1,24 @@
 package ffimage
 
 import (
+	"bytes"
 	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"math/rand"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	ffmpeg "github.com/u2takey/ffmpeg-go"
+	"gopkg.in/vansante/go-ffprobe.v2"
 )
 
 func newImage(a *assert.Assertions, name string) *Image {
@@ -614,3 +626,1429 @@ func TestAddArguments(test *testing.T) {
 	lastArg := img.Output.Args[len(img.Output.Args)-1]
 	a.Equal(ffmpeg.KwArgs{"cpu-used": 8}, lastArg)
 }
+
+func TestPackSprites(test *testing.T) {
+	a := assert.New(test)
+	output := newOutput("sprite.png")
+
+	sheet, err := PackSprites([]string{"./test/source.png", "./test/source.gif", "./test/source.webp"}, output, 2)
+	a.NoError(err)
+
+	a.Len(sheet.Sprites, 3)
+	a.Equal(431+96, sheet.Width)
+	a.Equal(324+128, sheet.Height)
+	a.Equal(431, sheet.Sprites[1].X)
+	a.Equal(324, sheet.Sprites[2].Y)
+	a.Contains(sheet.CSS("icon"), ".icon-source {")
+
+	img, err := NewImage(output)
+	a.NoError(err)
+
+	a.Equal(sheet.Width, img.GetWidth())
+	a.Equal(sheet.Height, img.GetHeight())
+}
+
+func TestSpriteName(test *testing.T) {
+	a := assert.New(test)
+	names := make(map[string]bool)
+
+	a.Equal("icon", spriteName(names, "a/icon.png"))
+	a.Equal("icon-2", spriteName(names, "b/icon.png"))
+	a.Equal("icon-3", spriteName(names, "c/icon.gif"))
+	a.Equal("logo", spriteName(names, "logo.png"))
+	a.Equal("my-icon-2x", spriteName(names, "my icon@2x.png"))
+	a.Equal("a--b-", spriteName(names, "a{}b\".png"))
+}
+
+func TestSpriteSheetCSS(test *testing.T) {
+	a := assert.New(test)
+	sheet := &SpriteSheet{Path: "dir/sprite \"1\".png", Sprites: []*Sprite{{Name: "home", X: 10, Y: 20, Width: 32, Height: 16}}}
+
+	a.Equal(".icon-home {\n  background: url(\"sprite \\\"1\\\".png\") -10px -20px no-repeat;\n  width: 32px;\n  height: 16px;\n}\n", sheet.CSS("icon"))
+	a.Contains(sheet.CSS("a.b"), ".a\\.b-home {")
+
+	a.Equal("\\31 23", cssIdent("123"))
+	a.Equal("-\\31 -a", cssIdent("-1-a"))
+	a.Equal("\\-", cssIdent("-"))
+	a.Equal("a\\{\\}\\a ", cssIdent("a{}\n"))
+	a.Equal(`"a\\b\"\a "`, cssString("a\\b\"\n"))
+}
+
+func TestPackFrames(test *testing.T) {
+	a := assert.New(test)
+	output := newOutput("sprite-frames.png")
+
+	sheet, err := PackFrames("./test/source.gif", output, 10)
+	a.NoError(err)
+
+	a.Len(sheet.Sprites, 60)
+	a.Equal(960, sheet.Width)
+	a.Equal(576, sheet.Height)
+	a.NotZero(sheet.Sprites[0].Duration)
+
+	b, err := sheet.JSON()
+	a.NoError(err)
+	a.Contains(string(b), `"duration"`)
+
+	img, err := NewImage(output)
+	a.NoError(err)
+
+	a.Equal(960, img.GetWidth())
+	a.Equal(576, img.GetHeight())
+}
+
+func TestBlurSharpenImage(test *testing.T) {
+	a := assert.New(test)
+	img, output := newImage(a, "source.png"), newOutput("blur-5.png")
+	err := img.BlurImage(5).WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.png"), newOutput("sharpen.png")
+	err = img.ResizeImage(200, 0).SharpenImage(1, 2, 0).WriteImage(output)
+	a.NoError(err)
+
+	// The alpha is kept while the color is sharpened.
+	src := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for p := 0; p < len(src.Pix); p += 4 {
+		copy(src.Pix[p:], []uint8{uint8(p % 256), 128, 64, uint8(p / 4 % 2 * 255)})
+	}
+	goImg, err := NewImageFromGoImage(src)
+	a.NoError(err)
+	dst, err := goImg.SharpenImage(1, 2, 10).ToGoImage()
+	a.NoError(err)
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			_, _, _, alpha := dst.At(x, y).RGBA()
+			a.Equal(uint32(src.NRGBAAt(x, y).A)*0x101, alpha)
+		}
+	}
+
+	img, output = newImage(a, "source.png"), newOutput("unsharp.png")
+	err = img.ResizeImage(200, 0).UnsharpMask(2, 1.5).WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(200, img.GetWidth())
+	a.Equal(150, img.GetHeight())
+}
+
+func TestKernelSize(test *testing.T) {
+	a := assert.New(test)
+	img := &Image{Width: 100, Height: 8}
+
+	a.Equal(3, img.kernelSize(0))
+	a.Equal(5, img.kernelSize(2))
+	a.Equal(7, img.kernelSize(10))
+
+	img.setWidthHeight(100, 100)
+	a.Equal(23, img.kernelSize(50))
+}
+
+func TestColorAdjustments(test *testing.T) {
+	a := assert.New(test)
+	img, output := newImage(a, "source.png"), newOutput("modulate-120-50-100.png")
+	err := img.ModulateImage(120, 50, 100).WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.png"), newOutput("contrast-1.5.png")
+	err = img.ContrastImage(1.5).WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.png"), newOutput("gamma-0.7.png")
+	err = img.GammaImage(0.7).WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.png"), newOutput("grayscale.png")
+	err = img.GrayscaleImage().WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.png"), newOutput("sepia.png")
+	err = img.SepiaImage().WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.png"), newOutput("tint.png")
+	err = img.TintImage("#FF9900", 0.5).WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(431, img.GetWidth())
+	a.Equal(324, img.GetHeight())
+}
+
+func TestRGBToHSL(test *testing.T) {
+	a := assert.New(test)
+
+	r, g, b, ok := parseHexColor("#FF9900")
+	a.True(ok)
+	h, s, l := rgbToHSL(r, g, b)
+	a.InDelta(36, h, 0.01)
+	a.InDelta(1, s, 0.01)
+	a.InDelta(0.5, l, 0.01)
+
+	_, _, _, ok = parseHexColor("blue")
+	a.False(ok)
+}
+
+func TestApplyLUT(test *testing.T) {
+	a := assert.New(test)
+	img, output := newImage(a, "source.png"), newOutput("lut-cube.png")
+	err := img.ApplyLUT("./test/warm.cube", 1).WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.png"), newOutput("lut-cube-50.png")
+	err = img.ApplyLUT("./test/warm.cube", 0.5).WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.gif"), newOutput("lut-hald.gif")
+	err = img.ApplyLUT("./test/hald.png", 1).WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(96, img.GetWidth())
+	a.Equal(96, img.GetHeight())
+	a.Equal(60, img.GetFrames())
+}
+
+func TestLevels(test *testing.T) {
+	a := assert.New(test)
+	img, output := newImage(a, "source.jpg"), newOutput("normalize.jpg")
+	err := img.ResizeImage(400, 0).NormalizeImage().WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.jpg"), newOutput("equalize.jpg")
+	err = img.ResizeImage(400, 0).EqualizeImage().WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.jpg"), newOutput("auto-levels.jpg")
+	err = img.ResizeImage(400, 0).AutoLevels(0.5).WriteImage(output)
+	a.NoError(err)
+	a.NotNil(img.Output.Levels)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(400, img.GetWidth())
+	a.Equal(301, img.GetHeight())
+}
+
+func TestCalcLevels(test *testing.T) {
+	a := assert.New(test)
+
+	// 100 opaque gray pixels from 50 to 149, and a transparent white pixel.
+	rgba := make([]byte, 0)
+	for v := 50; v < 150; v++ {
+		rgba = append(rgba, byte(v), byte(v), byte(v), 255)
+	}
+	rgba = append(rgba, 255, 255, 255, 0)
+
+	levels := calcLevels(rgba, 0)
+	a.Equal([3]int{50, 50, 50}, levels.Black)
+	a.Equal([3]int{149, 149, 149}, levels.White)
+
+	levels = calcLevels(rgba, 5)
+	a.Equal([3]int{55, 55, 55}, levels.Black)
+	a.Equal([3]int{144, 144, 144}, levels.White)
+}
+
+func TestRoundCornersCircleMask(test *testing.T) {
+	a := assert.New(test)
+	img, output := newImage(a, "source.png"), newOutput("round-corners-50.png")
+	err := img.RoundCorners(50).WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.png"), newOutput("round-corners-50.jpg")
+	err = img.SetBackgroundColor("white").RoundCorners(50).WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.png"), newOutput("circle-mask.png")
+	err = img.CropThumbnailImage(300, 300).CircleMask().WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(300, img.GetWidth())
+	a.Equal(300, img.GetHeight())
+}
+
+func TestOpaqueColor(test *testing.T) {
+	a := assert.New(test)
+
+	a.Equal("black", opaqueColor("black@0.5"))
+	a.Equal("#000000", opaqueColor("#00000000"))
+	a.Equal("0xFF9900", opaqueColor("0xFF9900"))
+	a.Equal("0xFF9900", opaqueColor("0xFF990080"))
+	a.Equal("FF9900", opaqueColor("FF990080"))
+	a.Equal("lavender", opaqueColor("lavender"))
+	a.Equal("darkblue", opaqueColor("darkblue@0.3"))
+	a.Equal("seashell", opaqueColor("seashell"))
+	a.Equal("darkgray", opaqueColor("darkgray"))
+}
+
+func TestBorderFrameImage(test *testing.T) {
+	a := assert.New(test)
+	img, output := newImage(a, "source.png"), newOutput("border-10.png")
+	err := img.BorderImage(10, "white").WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(451, img.GetWidth())
+	a.Equal(344, img.GetHeight())
+
+	img, output = newImage(a, "source.png"), newOutput("frame-inner-10.png")
+	err = img.FrameImage(10, "white", FrameTypeInner).WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(431, img.GetWidth())
+	a.Equal(324, img.GetHeight())
+}
+
+func TestDropShadow(test *testing.T) {
+	a := assert.New(test)
+	img, output := newImage(a, "source.png"), newOutput("drop-shadow.png")
+	err := img.RoundCorners(30).DropShadow(10, 10, 5, "#000000", 0.6).WriteImage(output)
+	a.NoError(err)
+	a.Equal(431+10+30, img.Width)
+	a.Equal(324+10+30, img.Height)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(471, img.GetWidth())
+	a.Equal(364, img.GetHeight())
+}
+
+func TestFlattenImage(test *testing.T) {
+	a := assert.New(test)
+	img, output := newImage(a, "source.png"), newOutput("flatten-white.jpg")
+	a.True(img.Output.IsTransparent)
+	err := img.SetMatteColor("white").SetImageFormat(ImageFormatJPEG).WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.png"), newOutput("flatten-blue.png")
+	err = img.SetBackgroundColor("blue").FlattenImage().WriteImage(output)
+	a.NoError(err)
+	a.False(img.Output.IsTransparent)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(431, img.GetWidth())
+	a.Equal(324, img.GetHeight())
+	a.False(img.Output.IsTransparent)
+}
+
+func TestHasAlpha(test *testing.T) {
+	a := assert.New(test)
+
+	a.True(hasAlpha("rgba"))
+	a.True(hasAlpha("yuva420p"))
+	a.True(hasAlpha("pal8"))
+	a.False(hasAlpha("yuvj420p"))
+	a.False(hasAlpha("rgb24"))
+}
+
+func TestRedactRegions(test *testing.T) {
+	a := assert.New(test)
+	rects := []Rect{{X: 50, Y: 50, Width: 100, Height: 80}, {X: 380, Y: 280, Width: 100, Height: 100}}
+
+	img, output := newImage(a, "source.png"), newOutput("redact-pixelate.png")
+	err := img.RedactRegions(rects, RedactModePixelate).WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.png"), newOutput("redact-blur.png")
+	err = img.RedactRegions(rects, RedactModeBlur).WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.gif"), newOutput("redact-fill.gif")
+	err = img.RedactRegions([]Rect{{X: 20, Y: 20, Width: 40, Height: 40}}, RedactModeFill).WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(96, img.GetWidth())
+	a.Equal(96, img.GetHeight())
+	a.Equal(60, img.GetFrames())
+}
+
+func TestRedactRegionsTransparent(test *testing.T) {
+	a := assert.New(test)
+	rect := Rect{X: 16, Y: 16, Width: 64, Height: 64}
+
+	// The semi-transparent checkerboard of red and blue, the redacted pixels should be the mix of both.
+	src := image.NewNRGBA(image.Rect(0, 0, 96, 96))
+	for y := 0; y < 96; y++ {
+		for x := 0; x < 96; x++ {
+			if (x+y)%2 == 0 {
+				src.SetNRGBA(x, y, color.NRGBA{R: 255, A: 128})
+			} else {
+				src.SetNRGBA(x, y, color.NRGBA{B: 255, A: 128})
+			}
+		}
+	}
+	for _, mode := range []RedactMode{RedactModePixelate, RedactModeBlur} {
+		img, err := NewImageFromGoImage(src)
+		a.NoError(err)
+
+		dst, err := img.RedactRegions([]Rect{rect}, mode).ToGoImage()
+		a.NoError(err)
+
+		for y := rect.Y; y < rect.Y+rect.Height; y++ {
+			for x := rect.X; x < rect.X+rect.Width; x++ {
+				c := color.NRGBAModel.Convert(dst.At(x, y)).(color.NRGBA)
+				a.InDelta(128, int(c.A), 2)
+				a.InDelta(int(c.R), int(c.B), 40, "mode %d at %d,%d: %v", mode, x, y, c)
+			}
+		}
+		c := color.NRGBAModel.Convert(dst.At(0, 0)).(color.NRGBA)
+		a.InDelta(255, int(c.R), 4)
+		a.InDelta(128, int(c.A), 2)
+	}
+}
+
+func TestClipRect(test *testing.T) {
+	a := assert.New(test)
+	img := &Image{Width: 100, Height: 100}
+
+	r, ok := img.clipRect(Rect{X: -10, Y: 90, Width: 50, Height: 50})
+	a.True(ok)
+	a.Equal(Rect{X: 0, Y: 90, Width: 40, Height: 10}, r)
+
+	_, ok = img.clipRect(Rect{X: 100, Y: 0, Width: 10, Height: 10})
+	a.False(ok)
+}
+
+func TestConvolveImage(test *testing.T) {
+	a := assert.New(test)
+	img, output := newImage(a, "source.png"), newOutput("convolve-box-blur.png")
+	err := img.ConvolveImage([][]float64{{1, 1, 1}, {1, 1, 1}, {1, 1, 1}}, 9, 0).WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.png"), newOutput("edge-detect.png")
+	err = img.EdgeDetectImage().WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.png"), newOutput("outline.png")
+	err = img.OutlineImage().WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.png"), newOutput("emboss.png")
+	err = img.EmbossImage().WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(431, img.GetWidth())
+	a.Equal(324, img.GetHeight())
+}
+
+func TestConvolutionMatrix(test *testing.T) {
+	a := assert.New(test)
+
+	matrix, rdiv, ok := convolutionMatrix([][]float64{{0, -1, 0}, {-1, 5, -1}, {0, -1, 0}}, 1)
+	a.True(ok)
+	a.Equal("0 -1 0 -1 5 -1 0 -1 0", matrix)
+	a.Equal(1.0, rdiv)
+
+	matrix, rdiv, ok = convolutionMatrix([][]float64{{0.5, 0, 0}, {0, 0.25, 0}, {0, 0, 0.25}}, 1)
+	a.True(ok)
+	a.Equal("50 0 0 0 25 0 0 0 25", matrix)
+	a.InDelta(0.01, rdiv, 0.0001)
+
+	_, _, ok = convolutionMatrix([][]float64{{1, 1}, {1, 1}}, 1)
+	a.False(ok)
+}
+
+func TestAddFilter(test *testing.T) {
+	a := assert.New(test)
+	img, output := newImage(a, "source.png"), newOutput("add-filter.png")
+	err := img.ResizeImage(200, 0).AddFilter("gblur", "sigma=3").WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.gif"), newOutput("add-filter-complex.gif")
+	err = img.AddFilterComplex("[in]split[a][b];[b]hflip[c];[a][c]hstack[out]").WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(192, img.GetWidth())
+	a.Equal(96, img.GetHeight())
+
+	img = newImage(a, "source.png")
+	err = img.AddFilterComplex("[in]split[a][b];[x]hflip[out]").WriteImage(newOutput("add-filter-complex-invalid.png"))
+	a.Error(err)
+}
+
+func TestBuildFilterComplex(test *testing.T) {
+	a := assert.New(test)
+
+	chains, err := parseFilterComplex("[in]split[a][b];[b]hflip,geq=lum='if(gt(X,10),255,0)'[c];[a][c]hstack")
+	a.NoError(err)
+	a.Len(chains, 3)
+	a.Equal([]string{"a", "b"}, chains[0][0].outputs)
+	a.Equal("geq", chains[1][1].name)
+	a.Equal("lum='if(gt(X,10),255,0)'", chains[1][1].args[0])
+
+	out, err := buildFilterComplex(chains, ffmpeg.Input("input.png"))
+	a.NoError(err)
+
+	args := out.Output("output.png").GetArgs()
+	a.Contains(args, "[0]split=2[s0][s1];[s1]hflip[s2];[s2]geq=lum=\\'if(gt(X\\,10)\\,255\\,0)\\'[s3];[s0][s3]hstack[s4]")
+
+	chains, err = parseFilterComplex("hflip,vflip")
+	a.NoError(err)
+	_, err = buildFilterComplex(chains, ffmpeg.Input("input.png"))
+	a.NoError(err)
+
+	chains, err = parseFilterComplex("[x]hflip")
+	a.NoError(err)
+	_, err = buildFilterComplex(chains, ffmpeg.Input("input.png"))
+	a.Error(err)
+}
+
+func TestToGoImage(test *testing.T) {
+	a := assert.New(test)
+	img := newImage(a, "source.png")
+
+	goImg, err := img.ResizeImage(200, 0).ToGoImage()
+	a.NoError(err)
+
+	a.Equal(200, goImg.Bounds().Dx())
+	a.Equal(150, goImg.Bounds().Dy())
+
+	img = newImage(a, "source.gif")
+	frames, err := img.ToGoImages()
+	a.NoError(err)
+
+	a.Len(frames, 60)
+	a.Equal(96, frames[0].Bounds().Dx())
+}
+
+func TestNewImageFromGoImage(test *testing.T) {
+	a := assert.New(test)
+
+	src := image.NewRGBA(image.Rect(0, 0, 120, 80))
+	draw.Draw(src, src.Bounds(), &image.Uniform{color.RGBA{255, 0, 0, 255}}, image.Point{}, draw.Src)
+
+	img, err := NewImageFromGoImage(src)
+	a.NoError(err)
+
+	a.Equal(120, img.GetWidth())
+	a.Equal(80, img.GetHeight())
+	// The pixels are piped without the temp file.
+	a.False(img.isTemp)
+	a.Error(img.WriteImage(""))
+
+	goImg, err := img.ToGoImage()
+	a.NoError(err)
+
+	r, g, b, _ := goImg.At(10, 10).RGBA()
+	a.Equal([]uint32{0xffff, 0, 0}, []uint32{r, g, b})
+
+	output := newOutput("from-go-image.png")
+	err = img.ResizeImage(60, 0).WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(60, img.GetWidth())
+	a.Equal(40, img.GetHeight())
+}
+
+func TestIsJXLUntouched(test *testing.T) {
+	a := assert.New(test)
+	newJPEG := func() *Image {
+		return &Image{
+			Path:   "source.jpg",
+			Stream: &ffprobe.Stream{CodecName: "mjpeg"},
+			Output: &Output{
+				Path:    "output.jxl",
+				Format:  ImageFormatJPEGXL,
+				JXL:     &JXLOptions{LosslessJPEG: true, Effort: 7},
+				Args:    []ffmpeg.KwArgs{{"map_metadata": "-1"}},
+				Filters: []*filter{{k: "format", args: ffmpeg.Args{"rgba"}}},
+			},
+		}
+	}
+	a.True(newJPEG().isJXLUntouched())
+
+	for _, fn := range []func(*Image){
+		func(i *Image) { i.Stream.CodecName = "png" },
+		func(i *Image) { i.Output.Path = i.Path },
+		func(i *Image) { i.Output.Quality = 80 },
+		func(i *Image) { i.Output.JXL.Distance = 1 },
+		func(i *Image) { i.Output.DropFrames = true },
+		func(i *Image) { i.seek = time.Second },
+		func(i *Image) { i.tileGrid = &tileGrid{} },
+		func(i *Image) { i.AddArguments(map[string]any{"vf": "hflip"}) },
+		func(i *Image) { i.addFilter("hflip", ffmpeg.Args{}) },
+	} {
+		img := newJPEG()
+		fn(img)
+		a.False(img.isJXLUntouched())
+	}
+}
+
+func TestStripJPEGMetadata(test *testing.T) {
+	a := assert.New(test)
+	// SOI, APP0 (JFIF), APP1 (EXIF), COM, APP2 (ICC), SOS with the entropy-coded data, EOI.
+	data := []byte{0xFF, 0xD8}
+	app0 := []byte{0xFF, 0xE0, 0, 4, 'J', 'F'}
+	app1 := []byte{0xFF, 0xE1, 0, 6, 'E', 'x', 'i', 'f'}
+	com := []byte{0xFF, 0xFE, 0, 3, 'x'}
+	app2 := []byte{0xFF, 0xE2, 0, 4, 'I', 'C'}
+	sos := []byte{0xFF, 0xDA, 0, 2, 1, 2, 3, 0xFF, 0xD9}
+	for _, v := range [][]byte{app0, app1, com, app2, sos} {
+		data = append(data, v...)
+	}
+	out, err := stripJPEGMetadata(data)
+	a.NoError(err)
+
+	want := []byte{0xFF, 0xD8}
+	for _, v := range [][]byte{app0, app2, sos} {
+		want = append(want, v...)
+	}
+	a.Equal(want, out)
+
+	_, err = stripJPEGMetadata([]byte("not a jpeg"))
+	a.Error(err)
+	_, err = stripJPEGMetadata([]byte{0xFF, 0xD8, 0xFF, 0xE1, 0, 100, 0})
+	a.Error(err)
+}
+
+func TestJXLConvertion(test *testing.T) {
+	a := assert.New(test)
+	img, output := newImage(a, "source.png"), newOutput("png-to-jxl.jxl")
+	err := img.SetImageFormat(ImageFormatJPEGXL).WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.png"), newOutput("png-to-jxl-lossless.jxl")
+	err = img.SetJXLOptions(JXLOptions{Lossless: true, Effort: 3}).WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.jpg"), newOutput("jpg-to-jxl-50.jxl")
+	err = img.SetQuality(50).ResizeImage(400, 0).WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.jpg"), newOutput("jpg-to-jxl-recompress.jxl")
+	err = img.SetJXLOptions(JXLOptions{LosslessJPEG: true}).WriteImage(output)
+	if _, lookErr := exec.LookPath("cjxl"); lookErr != nil {
+		a.Error(err)
+	} else {
+		a.NoError(err)
+	}
+
+	// The lossless recompression can't be applied to the resized image.
+	img, output = newImage(a, "source.jpg"), newOutput("jpg-to-jxl-recompress-resized.jxl")
+	err = img.ResizeImage(400, 0).SetJXLOptions(JXLOptions{LosslessJPEG: true}).WriteImage(output)
+	a.Error(err)
+
+	img, output = newImage(a, "source.gif"), newOutput("gif-to-jxl.jxl")
+	err = img.SetImageFormat(ImageFormatJPEGXL).WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(96, img.GetWidth())
+	a.Equal(96, img.GetHeight())
+
+	// Round-trip back to PNG with the alpha.
+	img, output = newImage(a, "output/png-to-jxl-lossless.jxl"), newOutput("jxl-to-png.png")
+	a.True(img.Output.IsTransparent)
+	err = img.SetImageFormat(ImageFormatPNG).WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(431, img.GetWidth())
+	a.Equal(324, img.GetHeight())
+}
+
+func TestJXLDistance(test *testing.T) {
+	a := assert.New(test)
+
+	a.Equal(0.0, jxlDistance(100))
+	a.InDelta(1.0, jxlDistance(90), 0.001)
+	a.InDelta(6.4, jxlDistance(30), 0.001)
+	a.InDelta(25, jxlDistance(0), 0.001)
+}
+
+func TestTileGrid(test *testing.T) {
+	a := assert.New(test)
+	grid := &tileGrid{
+		codedWidth:  1024,
+		codedHeight: 1024,
+		width:       1000,
+		height:      800,
+		rotation:    90,
+		tiles:       []*tile{{index: 1, x: 0, y: 0}, {index: 2, x: 512, y: 0}, {index: 3, x: 0, y: 512}, {index: 4, x: 512, y: 512}},
+	}
+	w, h := grid.size()
+	a.Equal(800, w)
+	a.Equal(1000, h)
+
+	args := strings.Join(grid.build(ffmpeg.Input("input.heic")).Output("output.png").GetArgs(), " ")
+	a.Contains(args, "[1:1]")
+	a.Contains(args, "[1:4]")
+	a.Contains(args, "crop=1000:800:0:0")
+	a.Contains(args, "transpose=clock")
+
+	a.False(isMirroredMatrix("00000000:            0       65536           0\n00000001:       -65536           0           0\n00000002:            0           0  1073741824\n"))
+	a.True(isMirroredMatrix("00000000:       -65536           0           0\n00000001:            0       65536           0\n00000002:            0           0  1073741824\n"))
+}
+
+func TestVideoStream(test *testing.T) {
+	a := assert.New(test)
+	audio := &ffprobe.Stream{CodecType: "audio"}
+	cover := &ffprobe.Stream{CodecType: "video", Width: 300, Height: 300, Disposition: ffprobe.StreamDisposition{AttachedPic: 1}}
+	video := &ffprobe.Stream{CodecType: "video", Width: 1920, Height: 1080}
+
+	a.Equal(video, videoStream([]*ffprobe.Stream{audio, cover, video}))
+	a.Nil(videoStream([]*ffprobe.Stream{audio}))
+	a.Nil(videoStream(nil))
+
+	a.True(isHEIF(&ffprobe.Format{TagList: ffprobe.Tags{"major_brand": "heic", "compatible_brands": "mif1heic"}}))
+	a.True(isHEIF(&ffprobe.Format{TagList: ffprobe.Tags{"major_brand": "avif", "compatible_brands": "avifmif1miaf"}}))
+	a.False(isHEIF(&ffprobe.Format{TagList: ffprobe.Tags{"major_brand": "isom", "compatible_brands": "isomiso2avc1mp41"}}))
+	a.False(isHEIF(&ffprobe.Format{}))
+}
+
+func TestTileGridConvertion(test *testing.T) {
+	a := assert.New(test)
+	// grid.avif is the 2x2 grid of the same 431x324 tile, cropped to 800x600. HEIC uses the same grid item of HEIF.
+	img, output := newImage(a, "grid.avif"), newOutput("grid-to-png.png")
+	a.NotNil(img.tileGrid)
+	a.Equal(800, img.GetWidth())
+	a.Equal(600, img.GetHeight())
+
+	err := img.WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(800, img.GetWidth())
+	a.Equal(600, img.GetHeight())
+}
+
+func TestTIFFTGAPPMQOIConvertion(test *testing.T) {
+	a := assert.New(test)
+	img, output := newImage(a, "source.png"), newOutput("png-to-tiff.tiff")
+	err := img.SetImageFormat(ImageFormatTIFF).WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.png"), newOutput("png-to-tiff-deflate.tif")
+	err = img.SetTIFFOptions(TIFFOptions{Compression: TIFFCompressionDeflate}).WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.png"), newOutput("png-to-tga.tga")
+	err = img.SetImageFormat(ImageFormatTGA).WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.png"), newOutput("png-to-ppm.ppm")
+	err = img.SetImageFormat(ImageFormatPPM).WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.png"), newOutput("png-to-pam.pam")
+	err = img.SetImageFormat(ImageFormatPAM).WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.gif"), newOutput("gif-to-qoi.qoi")
+	err = img.SetImageFormat(ImageFormatQOI).WriteImage(output)
+	a.NoError(err)
+
+	for _, v := range []string{"png-to-tiff.tiff", "png-to-tiff-deflate.tif", "png-to-tga.tga", "png-to-ppm.ppm", "png-to-pam.pam"} {
+		img, output = newImage(a, "output/"+v), newOutput(v+"-to-png.png")
+		a.Equal(1, img.GetPages())
+		err = img.SetImageFormat(ImageFormatPNG).WriteImage(output)
+		a.NoError(err)
+
+		img, err = NewImage(output)
+		a.NoError(err)
+
+		a.Equal(431, img.GetWidth())
+		a.Equal(324, img.GetHeight())
+	}
+	img, err = NewImage(newOutput("gif-to-qoi.qoi"))
+	a.NoError(err)
+
+	a.Equal(96, img.GetWidth())
+	a.Equal(96, img.GetHeight())
+}
+
+func TestCountTIFFPages(test *testing.T) {
+	a := assert.New(test)
+
+	// Header, then 2 IFDs with no entry: the first points to the second, the second ends the chain.
+	data := []byte{'I', 'I', 42, 0, 8, 0, 0, 0}
+	data = append(data, 0, 0, 14, 0, 0, 0)
+	data = append(data, 0, 0, 0, 0, 0, 0)
+	pages, err := countTIFFPages(data)
+	a.NoError(err)
+	a.Equal(2, pages)
+
+	data = []byte{'M', 'M', 0, 42, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0}
+	pages, err = countTIFFPages(data)
+	a.NoError(err)
+	a.Equal(1, pages)
+
+	_, err = countTIFFPages([]byte("not a tiff"))
+	a.Error(err)
+
+	// BigTIFF.
+	_, err = countTIFFPages([]byte{'I', 'I', 43, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	a.Error(err)
+
+	// The IFD points beyond the data, and the entries of the IFD are cut off.
+	_, err = countTIFFPages([]byte{'I', 'I', 42, 0, 64, 0, 0, 0})
+	a.Error(err)
+	_, err = countTIFFPages([]byte{'I', 'I', 42, 0, 8, 0, 0, 0, 2, 0, 0, 0})
+	a.Error(err)
+
+	// The IFD points to itself, and 2 IFDs point to each other.
+	_, err = countTIFFPages([]byte{'I', 'I', 42, 0, 8, 0, 0, 0, 0, 0, 8, 0, 0, 0})
+	a.Error(err)
+	data = []byte{'I', 'I', 42, 0, 8, 0, 0, 0}
+	data = append(data, 0, 0, 14, 0, 0, 0)
+	data = append(data, 0, 0, 8, 0, 0, 0)
+	_, err = countTIFFPages(data)
+	a.Error(err)
+}
+
+func TestICOConvertion(test *testing.T) {
+	a := assert.New(test)
+	img, output := newImage(a, "source.png"), newOutput("png-to-ico.ico")
+	err := img.SetImageFormat(ImageFormatICO).WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(256, img.GetWidth())
+	a.Equal(192, img.GetHeight())
+}
+
+func TestFaviconSet(test *testing.T) {
+	a := assert.New(test)
+	img := newImage(a, "source.png")
+	bundle, err := img.FaviconSet(newOutput("favicon.ico"), FaviconOptions{AppleTouchIcon: true, Manifest: true})
+	a.NoError(err)
+
+	a.Equal([]int{16, 32, 48, 64, 256}, bundle.Sizes)
+	data, err := os.ReadFile(bundle.Path)
+	a.NoError(err)
+	a.Equal([]byte{0, 0, 1, 0, 5, 0}, data[:6])
+
+	img, err = NewImage(bundle.AppleTouchIcon)
+	a.NoError(err)
+	a.Equal(180, img.GetWidth())
+	a.Equal(180, img.GetHeight())
+
+	a.Len(bundle.Icons, 2)
+	img, err = NewImage(bundle.Icons[1].Path)
+	a.NoError(err)
+	a.Equal(512, img.GetWidth())
+	a.Equal(512, img.GetHeight())
+
+	manifest, err := bundle.Manifest("/")
+	a.NoError(err)
+	a.Contains(string(manifest), `"src": "/icon-192.png"`)
+	a.Contains(string(manifest), `"sizes": "512x512"`)
+
+	// The padding of the apple touch icon is filled with the matte color.
+	bundle, err = newImage(a, "source.png").SetBackgroundColor("blue").SetMatteColor("red").FaviconSet(newOutput("favicon-matte.ico"), FaviconOptions{AppleTouchIcon: true})
+	a.NoError(err)
+	f, err := os.Open(bundle.AppleTouchIcon)
+	a.NoError(err)
+	icon, err := png.Decode(f)
+	a.NoError(err)
+	a.NoError(f.Close())
+	r, g, b, _ := icon.At(90, 0).RGBA()
+	a.Equal([]uint32{0xffff, 0, 0}, []uint32{r, g, b})
+
+	_, err = newImage(a, "source.png").FaviconSet(newOutput("favicon-invalid.ico"), FaviconOptions{Sizes: []int{512}})
+	a.Error(err)
+}
+
+func TestEncodeICO(test *testing.T) {
+	a := assert.New(test)
+	data := encodeICO([]int{16, 256}, [][]byte{[]byte("abc"), []byte("de")})
+
+	a.Equal([]byte{0, 0, 1, 0, 2, 0}, data[:6])
+	a.Equal([]byte{16, 16, 0, 0, 1, 0, 32, 0, 3, 0, 0, 0, 38, 0, 0, 0}, data[6:22])
+	a.Equal([]byte{0, 0, 0, 0, 1, 0, 32, 0, 2, 0, 0, 0, 41, 0, 0, 0}, data[22:38])
+	a.Equal("abcde", string(data[38:]))
+}
+
+func TestWebPOptions(test *testing.T) {
+	a := assert.New(test)
+	img, output := newImage(a, "source.png"), newOutput("png-to-webp-lossless.webp")
+	method := 6
+	err := img.SetWebPOptions(WebPOptions{Lossless: true, Method: &method}).WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.png"), newOutput("png-to-webp-text.webp")
+	err = img.SetQuality(50).SetWebPOptions(WebPOptions{Preset: WebPPresetText, AlphaQuality: 50}).WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.png"), newOutput("png-to-webp-near-lossless.webp")
+	err = img.SetWebPOptions(WebPOptions{NearLossless: 40}).WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(431, img.GetWidth())
+	a.Equal(324, img.GetHeight())
+
+	method = 9
+	img = newImage(a, "source.png").SetImageFormat(ImageFormatWEBP).SetWebPOptions(WebPOptions{Lossless: true, Preset: WebPPresetPhoto, Method: &method})
+	img.buildWebP()
+	a.Contains(img.Output.Args, ffmpeg.KwArgs{"preset": "photo"})
+	a.Contains(img.Output.Args, ffmpeg.KwArgs{"compression_level": 6})
+	a.Contains(img.Output.Args, ffmpeg.KwArgs{"lossless": 1})
+
+	method = 0
+	img = &Image{Output: &Output{Format: ImageFormatWEBP, WebP: &WebPOptions{Method: &method}}}
+	img.buildWebP()
+	a.Contains(img.Output.Args, ffmpeg.KwArgs{"compression_level": 0})
+
+	img = &Image{Output: &Output{Format: ImageFormatWEBP, WebP: &WebPOptions{}}}
+	img.buildWebP()
+	a.Empty(img.Output.Args)
+}
+
+func TestAVIFOptions(test *testing.T) {
+	a := assert.New(test)
+	img, output := newImage(a, "source.png"), newOutput("png-to-avif-444-10bit.avif")
+	err := img.SetAVIFOptions(AVIFOptions{Speed: 8, Chroma: AVIFChroma444, BitDepth: 10, TileColumns: 2, TileRows: 2}).WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(431, img.GetWidth())
+	a.Equal(324, img.GetHeight())
+	a.Equal("yuv444p10le", img.Stream.PixFmt)
+
+	img, output = newImage(a, "source.jpg"), newOutput("jpg-to-avif-lossless.avif")
+	err = img.SetAVIFOptions(AVIFOptions{Speed: 10, Lossless: true}).WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.png"), newOutput("png-to-avif-svt.avif")
+	err = img.SetQuality(60).SetAVIFOptions(AVIFOptions{Encoder: AVIFEncoderSVT, Speed: 10}).WriteImage(output)
+	a.NoError(err)
+}
+
+func TestSelectAVIFEncoder(test *testing.T) {
+	a := assert.New(test)
+	available := map[string]bool{"libsvtav1": true, "librav1e": true}
+
+	a.Equal(AVIFEncoderSVT, selectAVIFEncoder(AVIFEncoderNone, false, available))
+	a.Equal(AVIFEncoderRav1e, selectAVIFEncoder(AVIFEncoderRav1e, false, available))
+	a.Equal(AVIFEncoderRav1e, selectAVIFEncoder(AVIFEncoderSVT, true, available))
+	a.Equal(AVIFEncoderAOM, selectAVIFEncoder(AVIFEncoderNone, false, map[string]bool{}))
+	a.Equal(AVIFEncoderSVT, selectAVIFEncoder(AVIFEncoderSVT, false, map[string]bool{}))
+}
+
+func TestJPEGOptions(test *testing.T) {
+	a := assert.New(test)
+	img, output := newImage(a, "source.png"), newOutput("png-to-jpg-444.jpg")
+	err := img.SetJPEGOptions(JPEGOptions{Chroma: JPEGChroma444}).WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal("yuvj444p", img.Stream.PixFmt)
+
+	img, output = newImage(a, "source.jpg"), newOutput("jpg-to-jpg-progressive.jpg")
+	err = img.SetQuality(80).SetJPEGOptions(JPEGOptions{Progressive: true, Optimize: true, RestartInterval: 1}).WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(4080, img.GetWidth())
+	a.Equal(3072, img.GetHeight())
+}
+
+func TestPNGOptions(test *testing.T) {
+	a := assert.New(test)
+	img, output := newImage(a, "source.png"), newOutput("png-to-png-16bit.png")
+	err := img.SetPNGOptions(PNGOptions{CompressionLevel: 9, Prediction: PNGPredictionMixed, BitDepth: 16}).WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal("rgba64be", img.Stream.PixFmt)
+
+	// The low byte of the 16 bits source survives the filters.
+	src := image.NewRGBA64(image.Rect(0, 0, 16, 16))
+	draw.Draw(src, src.Bounds(), &image.Uniform{color.RGBA64{R: 0x1234, G: 0x5678, B: 0x9abc, A: 0xffff}}, image.Point{}, draw.Src)
+	f, err := os.Create(newOutput("png-16bit-source.png"))
+	a.NoError(err)
+	a.NoError(png.Encode(f, src))
+	a.NoError(f.Close())
+
+	img, output = newImage(a, "output/png-16bit-source.png"), newOutput("png-16bit-to-png-16bit.png")
+	err = img.ResizeImage(8, 8).SetPNGOptions(PNGOptions{BitDepth: 16}).WriteImage(output)
+	a.NoError(err)
+
+	f, err = os.Open(output)
+	a.NoError(err)
+	decoded, err := png.Decode(f)
+	a.NoError(err)
+	a.NoError(f.Close())
+
+	r, g, b, _ := decoded.At(4, 4).RGBA()
+	a.Equal([]uint32{0x1234, 0x5678, 0x9abc}, []uint32{r, g, b})
+
+	img, output = newImage(a, "source.png"), newOutput("png-to-png-palette.png")
+	err = img.SetPNGOptions(PNGOptions{Palette: true, Colors: 64, Interlace: true}).WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal("pal8", img.Stream.PixFmt)
+	a.Equal(431, img.GetWidth())
+	a.Equal(324, img.GetHeight())
+}
+
+func TestKeepHighBitDepth(test *testing.T) {
+	a := assert.New(test)
+	img := &Image{Output: &Output{Format: ImageFormatPNG, PNG: &PNGOptions{BitDepth: 16}}}
+	img.addFilter("format", ffmpeg.Args{"rgba"})
+	img.addFilter("hflip", ffmpeg.Args{})
+	img.buildPNG()
+
+	a.Equal(ffmpeg.Args{"rgba64le"}, img.Output.Filters[0].args)
+	a.Equal("hflip", img.Output.Filters[1].k)
+
+	img = &Image{Output: &Output{Format: ImageFormatPNG, PNG: &PNGOptions{}}}
+	img.addFilter("format", ffmpeg.Args{"rgba"})
+	img.buildPNG()
+
+	a.Equal(ffmpeg.Args{"rgba"}, img.Output.Filters[0].args)
+}
+
+func TestBuildPalette(test *testing.T) {
+	a := assert.New(test)
+	img := &Image{Output: &Output{Format: ImageFormatPNG, PNG: &PNGOptions{Palette: true, Colors: 2}}}
+
+	args := strings.Join(img.buildPalette(ffmpeg.Input("input.png")).Output("output.png").GetArgs(), " ")
+	a.Contains(args, "palettegen=max_colors=4")
+
+	img.Output.PNG.Colors = 1000
+	args = strings.Join(img.buildPalette(ffmpeg.Input("input.png")).Output("output.png").GetArgs(), " ")
+	a.Contains(args, "palettegen=max_colors=256")
+}
+
+func TestQuantizePNG(test *testing.T) {
+	a := assert.New(test)
+	data, err := os.ReadFile("./test/source.png")
+	a.NoError(err)
+	a.NoError(os.WriteFile(newOutput("png-quantized.png"), data, 0644))
+
+	ok, err := quantizePNG(newOutput("png-quantized.png"), 50)
+	a.NoError(err)
+	a.True(ok)
+
+	f, err := os.Open(newOutput("png-quantized.png"))
+	a.NoError(err)
+	defer f.Close()
+	img, err := png.Decode(f)
+	a.NoError(err)
+
+	paletted, ok := img.(*image.Paletted)
+	a.True(ok)
+	a.LessOrEqual(len(paletted.Palette), 23)
+	a.Equal(image.Rect(0, 0, 431, 324), paletted.Bounds())
+
+	ok, err = quantizePNG(newOutput("png-quantized.png"), 50)
+	a.NoError(err)
+	a.False(ok)
+}
+
+func TestMedianCut(test *testing.T) {
+	a := assert.New(test)
+	colors := []color.NRGBA{{R: 255, A: 255}, {G: 255, A: 255}, {B: 255, A: 255}, {}}
+	src := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for k := range src.Pix[:len(src.Pix)/4] {
+		src.SetNRGBA(k%4, k/4, colors[k%4])
+	}
+
+	palette := medianCut(src, 4)
+	a.Len(palette, 4)
+	for _, v := range colors {
+		a.Contains(palette, color.Color(v))
+	}
+	a.Len(medianCut(src, 256), 4)
+	a.Len(medianCut(src, 2), 2)
+}
+
+func TestOptimizeGIF(test *testing.T) {
+	a := assert.New(test)
+	palette := color.Palette{color.NRGBA{A: 255}, color.NRGBA{R: 255, A: 255}, color.NRGBA{G: 255, A: 255}}
+	src := &gif.GIF{LoopCount: 0}
+	for k := 0; k < 4; k++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 64, 64), palette)
+		for p := range frame.Pix {
+			frame.Pix[p] = uint8(p % 2)
+		}
+		draw.Draw(frame, image.Rect(k*8, k*8, k*8+8, k*8+8), image.NewUniform(palette[2]), image.Point{}, draw.Src)
+		src.Image = append(src.Image, frame)
+		src.Delay = append(src.Delay, 10)
+	}
+	f, err := os.Create(newOutput("moving-square-optimized.gif"))
+	a.NoError(err)
+	a.NoError(gif.EncodeAll(f, src))
+	a.NoError(f.Close())
+
+	ok, err := optimizeGIF(newOutput("moving-square-optimized.gif"), 100)
+	a.NoError(err)
+	a.True(ok)
+
+	f, err = os.Open(newOutput("moving-square-optimized.gif"))
+	a.NoError(err)
+	defer f.Close()
+	dst, err := gif.DecodeAll(f)
+	a.NoError(err)
+
+	a.Len(dst.Image, 4)
+	a.Equal([]int{10, 10, 10, 10}, dst.Delay)
+	a.Equal(image.Rect(0, 0, 64, 64), dst.Image[0].Bounds())
+	a.Equal(image.Rect(0, 0, 16, 16), dst.Image[1].Bounds())
+}
+
+func TestBuiltinOptimizer(test *testing.T) {
+	a := assert.New(test)
+	data, err := os.ReadFile("./test/source.png")
+	a.NoError(err)
+	output := newOutput("builtin-optimized.png")
+	a.NoError(os.WriteFile(output, data, 0644))
+
+	ok, err := quantizePNG(output, 30)
+	a.NoError(err)
+	a.True(ok)
+
+	f, err := os.Open(output)
+	a.NoError(err)
+	defer f.Close()
+	img, err := png.Decode(f)
+	a.NoError(err)
+
+	paletted, ok := img.(*image.Paletted)
+	a.True(ok)
+	a.LessOrEqual(len(paletted.Palette), 11)
+	stat, err := f.Stat()
+	a.NoError(err)
+	a.Less(stat.Size(), int64(len(data)))
+
+	// The noisy background stays the same and only a small square moves between frames.
+	palette := color.Palette{}
+	for k := 0; k < 64; k++ {
+		palette = append(palette, color.NRGBA{R: uint8(k * 4), G: uint8(255 - k*4), B: uint8(k * 2), A: 255})
+	}
+	src := &gif.GIF{}
+	for k := 0; k < 8; k++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 128, 128), palette)
+		for p := range frame.Pix {
+			frame.Pix[p] = uint8((p*7919 + p/128*104729) % 63)
+		}
+		draw.Draw(frame, image.Rect(k*8, k*8, k*8+16, k*8+16), image.NewUniform(palette[63]), image.Point{}, draw.Src)
+		src.Image = append(src.Image, frame)
+		src.Delay = append(src.Delay, 10)
+	}
+	buf := bytes.NewBuffer(nil)
+	a.NoError(gif.EncodeAll(buf, src))
+	output = newOutput("builtin-optimized.gif")
+	a.NoError(os.WriteFile(output, buf.Bytes(), 0644))
+
+	ok, err = optimizeGIF(output, 30)
+	a.NoError(err)
+	a.True(ok)
+
+	data, err = os.ReadFile(output)
+	a.NoError(err)
+	a.Less(len(data), buf.Len())
+
+	dst, err := gif.DecodeAll(bytes.NewReader(data))
+	a.NoError(err)
+	a.Len(dst.Image, 8)
+	a.Equal(image.Rect(0, 0, 128, 128), dst.Image[0].Bounds())
+	a.Equal(image.Rect(0, 0, 24, 24), dst.Image[1].Bounds())
+}
+
+func TestOptimizerOutput(test *testing.T) {
+	a := assert.New(test)
+	img, output := newImage(a, "source.png"), newOutput("png-to-png-optimized.png")
+	err := img.SetQuality(50).WriteImage(output)
+	a.NoError(err)
+	if _, err := exec.LookPath("pngquant"); err == nil {
+		a.Equal(OptimizerPNGQuant, img.Output.Optimizer)
+	} else {
+		a.Equal(OptimizerBuiltin, img.Output.Optimizer)
+	}
+
+	img, output = newImage(a, "source.gif"), newOutput("gif-to-gif-optimized.gif")
+	err = img.SetQuality(50).WriteImage(output)
+	a.NoError(err)
+	if _, err := exec.LookPath("gifsicle"); err == nil {
+		a.Equal(OptimizerGifsicle, img.Output.Optimizer)
+	}
+
+	// Only ffmpeg and ffprobe can be found, so the built-in optimizer is used.
+	dir := test.TempDir()
+	for _, v := range []string{"ffmpeg", "ffprobe"} {
+		path, err := exec.LookPath(v)
+		a.NoError(err)
+		a.NoError(os.Symlink(path, filepath.Join(dir, v)))
+	}
+	test.Setenv("PATH", dir)
+
+	img, output = newImage(a, "source.png"), newOutput("png-to-png-builtin.png")
+	err = img.SetQuality(50).WriteImage(output)
+	a.NoError(err)
+	a.Equal(OptimizerBuiltin, img.Output.Optimizer)
+
+	stat, err := os.Stat(output)
+	a.NoError(err)
+	source, err := os.Stat("./test/source.png")
+	a.NoError(err)
+	a.Less(stat.Size(), source.Size())
+}
+
+func TestLossyLZW(test *testing.T) {
+	a := assert.New(test)
+	r := rand.New(rand.NewSource(1))
+	palette := color.Palette{color.NRGBA{}}
+	for k := 0; k < 63; k++ {
+		palette = append(palette, color.NRGBA{R: uint8(k * 2), G: uint8(k * 2), B: uint8(k * 2), A: 255})
+	}
+	src := image.NewPaletted(image.Rect(0, 0, 128, 128), palette)
+	for p := range src.Pix {
+		src.Pix[p] = uint8(1 + r.Intn(63))
+	}
+	// The transparent pixels must stay transparent.
+	draw.Draw(src, image.Rect(32, 32, 64, 64), image.NewUniform(palette[0]), image.Point{}, draw.Src)
+	dst := image.NewPaletted(src.Rect, palette)
+	copy(dst.Pix, src.Pix)
+	lossyLZW(dst, 16)
+
+	for p := range src.Pix {
+		c, d := palette[src.Pix[p]].(color.NRGBA), palette[dst.Pix[p]].(color.NRGBA)
+		a.LessOrEqual(colorDistance(c, d), 16)
+		a.Equal(c.A == 0, d.A == 0)
+	}
+	lossless, lossy := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+	a.NoError(gif.Encode(lossless, src, nil))
+	a.NoError(gif.Encode(lossy, dst, nil))
+	a.Less(lossy.Len(), lossless.Len()*3/4)
+}
+
+func TestGIFOptions(test *testing.T) {
+	a := assert.New(test)
+	img, output := newImage(a, "source.gif"), newOutput("gif-to-gif-bayer.gif")
+	err := img.SetGIFOptions(GIFOptions{MaxColors: 32, StatsMode: GIFStatsModeDiff, Dither: GIFDitherBayer, BayerScale: 3, DiffRectangle: true}).WriteImage(output)
+	a.NoError(err)
+
+	img, output = newImage(a, "source.gif"), newOutput("gif-to-gif-single.gif")
+	err = img.SetGIFOptions(GIFOptions{StatsMode: GIFStatsModeSingle, Dither: GIFDitherOff, AlphaThreshold: 64}).WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(96, img.GetWidth())
+	a.Equal(96, img.GetHeight())
+	a.Equal(60, img.GetFrames())
+}
+
+func TestGIFPaletteArgs(test *testing.T) {
+	a := assert.New(test)
+	img := &Image{Output: &Output{}}
+	palettegen, paletteuse := img.gifPaletteArgs()
+	a.Empty(palettegen)
+	a.Empty(paletteuse)
+
+	img.Output.GIF = &GIFOptions{MaxColors: 1000, StatsMode: GIFStatsModeSingle, Dither: GIFDitherBayer, BayerScale: 9, DiffRectangle: true, AlphaThreshold: 64}
+	palettegen, paletteuse = img.gifPaletteArgs()
+	a.Equal(ffmpeg.Args{"max_colors=256", "stats_mode=single"}, palettegen)
+	a.Equal(ffmpeg.Args{"new=1", "dither=bayer", "bayer_scale=5", "diff_mode=rectangle", "alpha_threshold=64"}, paletteuse)
+
+	img.Output.GIF = &GIFOptions{Dither: GIFDitherSierra3, BayerScale: 3}
+	_, paletteuse = img.gifPaletteArgs()
+	a.Equal(ffmpeg.Args{"dither=sierra3"}, paletteuse)
+
+	img.Output.GIF = &GIFOptions{MaxColors: 2}
+	palettegen, _ = img.gifPaletteArgs()
+	a.Equal(ffmpeg.Args{"max_colors=4"}, palettegen)
+}
+
+func TestAnimatedAVIFJXL(test *testing.T) {
+	a := assert.New(test)
+	durations, err := probeFrameDurations("./test/source.gif")
+	a.NoError(err)
+
+	img, output := newImage(a, "source.gif"), newOutput("gif-to-avif-animated.avif")
+	err = img.SetLoop(2).SetAVIFOptions(AVIFOptions{Speed: 10, KeyframeInterval: 10, Timescale: 1000}).WriteImage(output)
+	a.NoError(err)
+
+	avifDurations, err := probeFrameDurations(output)
+	a.NoError(err)
+	a.Equal(durations, avifDurations)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+	a.Equal("1/1000", img.Stream.TimeBase)
+
+	img, output = newImage(a, "source.gif"), newOutput("gif-to-jxl-animated.jxl")
+	err = img.SetJXLOptions(JXLOptions{Effort: 3}).WriteImage(output)
+	a.NoError(err)
+
+	jxlDurations, err := probeFrameDurations(output)
+	a.NoError(err)
+	// Only the first frame is kept without the animation encoder.
+	if availableEncoders()["libjxl_anim"] {
+		a.Equal(durations, jxlDurations)
+	} else {
+		a.Len(jxlDurations, 1)
+	}
+}
+
+func TestAVIFLoop(test *testing.T) {
+	a := assert.New(test)
+	a.Equal(1, avifLoop(-1))
+	a.Equal(0, avifLoop(0))
+	a.Equal(2, avifLoop(1))
+	a.Equal(4, avifLoop(3))
+}
+
+func TestVideoConvertion(test *testing.T) {
+	a := assert.New(test)
+	img, output := newImage(a, "source.gif"), newOutput("gif-to-mp4.mp4")
+	err := img.ResizeImage(95, 95).WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(96, img.GetWidth())
+	a.Equal(96, img.GetHeight())
+	a.Equal(60, img.GetFrames())
+	a.Equal("h264", img.Stream.CodecName)
+	a.Equal("yuv420p", img.Stream.PixFmt)
+
+	img, output = newImage(a, "source.gif"), newOutput("gif-to-mp4-loop-1.mp4")
+	err = img.SetLoop(1).SetQuality(60).WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(120, img.GetFrames())
+
+	img, output = newImage(a, "source.gif"), newOutput("gif-to-webm.webm")
+	err = img.SetImageFramerate(10).WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(96, img.GetWidth())
+	a.Equal(96, img.GetHeight())
+	a.Equal("vp9", img.Stream.CodecName)
+}
+
+func TestBuildLoop(test *testing.T) {
+	a := assert.New(test)
+	img := &Image{Path: "source.gif", Stream: &ffprobe.Stream{NbFrames: "60"}, Output: &Output{Format: ImageFormatMP4, Loop: 2}}
+	img.buildLoop()
+
+	a.Empty(img.Output.Filters)
+	a.Equal([]string{"-stream_loop", "2", "-i", "source.gif", "output.mp4"}, img.input().Output("output.mp4").GetArgs())
+
+	img = &Image{Path: "pipe:", pixels: []byte{}, Stream: &ffprobe.Stream{NbFrames: "60"}, Output: &Output{Format: ImageFormatMP4, Loop: 2}}
+	img.buildLoop()
+
+	a.Zero(img.streamLoop)
+	a.Equal("loop", img.Output.Filters[0].k)
+	a.Equal(ffmpeg.Args{"loop=2:size=60"}, img.Output.Filters[0].args)
+}
+
+func TestNewImageFromVideo(test *testing.T) {
+	a := assert.New(test)
+	img, err := NewImageFromVideo("./test/source.gif", 500*time.Millisecond)
+	a.NoError(err)
+
+	output := newOutput("video-frame-500ms.png")
+	err = img.WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(96, img.GetWidth())
+	a.Equal(96, img.GetHeight())
+	a.Equal(0, img.GetFrames())
+
+	_, err = NewImageFromVideo("./test/source.gif", time.Hour)
+	a.Error(err)
+
+	img, output = newImage(a, "source.gif"), newOutput("video-best-frame.png")
+	err = img.SelectBestFrame(0).ResizeImage(48, 48).WriteImage(output)
+	a.NoError(err)
+
+	img, err = NewImage(output)
+	a.NoError(err)
+
+	a.Equal(48, img.GetWidth())
+	a.Equal(48, img.GetHeight())
+}
+
+func TestSkipBlackFrames(test *testing.T) {
+	a := assert.New(test)
+	a.Equal(time.Duration(0), skipBlackFrames(""))
+
+	log := "[blackdetect @ 0x1] black_start:0 black_end:2.04 black_duration:2.04\n" +
+		"[blackdetect @ 0x1] black_start:2.04 black_end:3.5 black_duration:1.46\n" +
+		"[blackdetect @ 0x1] black_start:10 black_end:11 black_duration:1\n"
+	a.Equal(3500*time.Millisecond, skipBlackFrames(log))
+
+	a.Equal(time.Duration(0), skipBlackFrames("[blackdetect @ 0x1] black_start:5 black_end:6 black_duration:1\n"))
+}
+
+func TestBlackdetectWriter(test *testing.T) {
+	a := assert.New(test)
+	var stopped bool
+	w := &blackdetectWriter{stop: func() { stopped = true }}
+
+	w.Write([]byte("Input #0, mov,mp4,m4a,3gp,3g2,mj2, from 'input.mp4':\n"))
+	a.False(stopped)
+	// The number might be cut off until the line is complete.
+	w.Write([]byte("[blackdetect @ 0x1] black_start:0 black_end:2"))
+	a.False(stopped)
+	w.Write([]byte(".04 black_duration:2.04\n"))
+	a.True(stopped)
+	a.Equal(2040*time.Millisecond, skipBlackFrames(w.buf.String()))
+}
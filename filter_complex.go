@@ -0,0 +1,167 @@
+package ffimage
+
+import (
+	"fmt"
+	"strings"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// AddFilter adds a custom ffmpeg filter to the filter chain, the filter is applied in order with the other operations. The args will be joined with ":", e.g. AddFilter("gblur", "sigma=5", "steps=2").
+//
+// NOTE: The tracked size (GetAspectRatio, positions) won't be updated if the filter changes the image size.
+func (i *Image) AddFilter(name string, args ...string) *Image {
+	i.addFilter(name, ffmpeg.Args(args))
+	return i
+}
+
+// AddFilterComplex adds a custom ffmpeg filtergraph to the filter chain, the filtergraph is applied in order with the other operations. Use "[in]" for the current image and "[out]" for the result, e.g. "[in]split[a][b];[b]hflip[c];[a][c]hstack[out]". The first input and the last output can be left unlabeled.
+//
+// NOTE: WriteImage returns the error if the filtergraph is invalid. The tracked size (GetAspectRatio, positions) won't be updated if the filtergraph changes the image size.
+func (i *Image) AddFilterComplex(graph string) *Image {
+	chains, err := parseFilterComplex(graph)
+	if err == nil {
+		// Build the filtergraph once with a placeholder input to validate the labels.
+		_, err = buildFilterComplex(chains, ffmpeg.Input("in"))
+	}
+	if err != nil {
+		i.err = fmt.Errorf("add filter complex: %w", err)
+		return i
+	}
+	i.addGraph(func(s *ffmpeg.Stream) *ffmpeg.Stream {
+		out, _ := buildFilterComplex(chains, s)
+		return out
+	})
+	return i
+}
+
+// complexFilter is a filter of the filtergraph with the labels of the input and output pads.
+type complexFilter struct {
+	name    string
+	args    ffmpeg.Args
+	inputs  []string
+	outputs []string
+}
+
+// parseFilterComplex parses the filtergraph into the chains of the filters.
+func parseFilterComplex(graph string) ([][]*complexFilter, error) {
+	var chains [][]*complexFilter
+
+	for _, c := range splitFilterGraph(graph, ';') {
+		if strings.TrimSpace(c) == "" {
+			continue
+		}
+		var chain []*complexFilter
+		for _, f := range splitFilterGraph(c, ',') {
+			filter := &complexFilter{}
+			f = strings.TrimSpace(f)
+
+			for strings.HasPrefix(f, "[") {
+				end := strings.Index(f, "]")
+				if end == -1 {
+					return nil, fmt.Errorf("unclosed label: %s", f)
+				}
+				filter.inputs = append(filter.inputs, f[1:end])
+				f = strings.TrimSpace(f[end+1:])
+			}
+			for strings.HasSuffix(f, "]") {
+				start := strings.LastIndex(f, "[")
+				if start == -1 {
+					return nil, fmt.Errorf("unopened label: %s", f)
+				}
+				filter.outputs = append([]string{f[start+1 : len(f)-1]}, filter.outputs...)
+				f = strings.TrimSpace(f[:start])
+			}
+			name, args, _ := strings.Cut(f, "=")
+			if name == "" {
+				return nil, fmt.Errorf("empty filter name: %s", c)
+			}
+			filter.name = name
+			if args != "" {
+				filter.args = ffmpeg.Args{args}
+			}
+			chain = append(chain, filter)
+		}
+		chains = append(chains, chain)
+	}
+	if len(chains) == 0 {
+		return nil, fmt.Errorf("empty filtergraph")
+	}
+	return chains, nil
+}
+
+// splitFilterGraph splits the filtergraph by the separator which isn't quoted or escaped.
+func splitFilterGraph(graph string, sep rune) []string {
+	var parts []string
+	var isQuoted, isEscaped bool
+	start := 0
+
+	for k, v := range graph {
+		switch {
+		case isEscaped:
+			isEscaped = false
+		case v == '\\':
+			isEscaped = true
+		case v == '\'':
+			isQuoted = !isQuoted
+		case v == sep && !isQuoted:
+			parts = append(parts, graph[start:k])
+			start = k + 1
+		}
+	}
+	return append(parts, graph[start:])
+}
+
+// buildFilterComplex links the chains of the filters to the input stream and returns the output stream.
+func buildFilterComplex(chains [][]*complexFilter, input *ffmpeg.Stream) (*ffmpeg.Stream, error) {
+	labels := map[string]*ffmpeg.Stream{"in": input}
+	var last *ffmpeg.Stream
+
+	for c, chain := range chains {
+		var prev *ffmpeg.Stream
+		for f, filter := range chain {
+			var streams []*ffmpeg.Stream
+			for _, l := range filter.inputs {
+				s, ok := labels[l]
+				if !ok {
+					return nil, fmt.Errorf("unknown label: %s", l)
+				}
+				// Every label can only be used once, the same as ffmpeg.
+				delete(labels, l)
+				streams = append(streams, s)
+			}
+			if prev != nil {
+				streams = append(streams, prev)
+			}
+			// The unlabeled first filter takes the current image.
+			if c == 0 && f == 0 && len(streams) == 0 {
+				streams = append(streams, labels["in"])
+				delete(labels, "in")
+			}
+			if len(streams) == 0 {
+				return nil, fmt.Errorf("no input for filter: %s", filter.name)
+			}
+			node := ffmpeg.FilterMultiOutput(streams, filter.name, filter.args)
+
+			prev = nil
+			if len(filter.outputs) == 0 {
+				prev = node.Stream("", "")
+				continue
+			}
+			for k, l := range filter.outputs {
+				// The labels are zero-padded since the output pads are sorted by the labels as strings.
+				labels[l] = node.Get(fmt.Sprintf("%03d", k))
+			}
+		}
+		if prev != nil {
+			last = prev
+		}
+	}
+	if out, ok := labels["out"]; ok {
+		return out, nil
+	}
+	if last == nil {
+		return nil, fmt.Errorf("no output found")
+	}
+	return last, nil
+}
@@ -0,0 +1,82 @@
+package ffimage
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// NewImageFromGoImage creates the image from Go's image.Image, the pixels are piped to ffmpeg as raw RGBA without encoding. WriteImage requires the output path since there's no source file.
+func NewImageFromGoImage(src image.Image) (*Image, error) {
+	bounds := src.Bounds()
+	if bounds.Empty() {
+		return nil, fmt.Errorf("empty image")
+	}
+	rgba, ok := src.(*image.NRGBA)
+	if !ok || rgba.Stride != bounds.Dx()*4 {
+		rgba = image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+	}
+	img, err := newImageWithInput("pipe:", ffmpeg.KwArgs{
+		"f":            "rawvideo",
+		"pixel_format": "rgba",
+		"video_size":   fmt.Sprintf("%dx%d", bounds.Dx(), bounds.Dy()),
+	}, rgba.Pix[:bounds.Dx()*bounds.Dy()*4])
+	if err != nil {
+		return nil, fmt.Errorf("new image: %w", err)
+	}
+	return img, nil
+}
+
+// ToGoImage converts the first frame of the image (with the applied operations) to Go's image.Image, the pixels are piped from ffmpeg as raw RGBA without encoding.
+//
+// NOTE: The filters from AddFilter and AddFilterComplex shouldn't change the image size since the size is tracked by the operations.
+func (i *Image) ToGoImage() (image.Image, error) {
+	frames, err := i.toGoImages(true)
+	if err != nil {
+		return nil, err
+	}
+	return frames[0], nil
+}
+
+// ToGoImages converts every frame of the image (with the applied operations) to Go's image.Image, the pixels are piped from ffmpeg as raw RGBA without encoding.
+//
+// NOTE: The filters from AddFilter and AddFilterComplex shouldn't change the image size since the size is tracked by the operations.
+func (i *Image) ToGoImages() ([]image.Image, error) {
+	return i.toGoImages(false)
+}
+
+// toGoImages
+func (i *Image) toGoImages(isFirstOnly bool) ([]image.Image, error) {
+	if i.err != nil {
+		return nil, i.err
+	}
+	args := ffmpeg.KwArgs{"f": "rawvideo", "fps_mode": "passthrough"}
+	if isFirstOnly {
+		args["frames:v"] = 1
+	}
+	buf, errBuf := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+	err := i.buildFilters(i.input()).
+		Filter("format", ffmpeg.Args{"rgba"}).
+		Output("pipe:", args).
+		Silent(i.Silent).WithInput(i.stdin()).WithOutput(buf).WithErrorOutput(errBuf).Run()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg output: %s", errBuf.String())
+	}
+	size := i.Width * i.Height * 4
+	if size == 0 || buf.Len() == 0 || buf.Len()%size != 0 {
+		return nil, fmt.Errorf("unexpected frame size: %d bytes for %dx%d", buf.Len(), i.Width, i.Height)
+	}
+	frames := make([]image.Image, 0, buf.Len()/size)
+	for b := buf.Bytes(); len(b) > 0; b = b[size:] {
+		frames = append(frames, &image.NRGBA{
+			Pix:    b[:size:size],
+			Stride: i.Width * 4,
+			Rect:   image.Rect(0, 0, i.Width, i.Height),
+		})
+	}
+	return frames, nil
+}
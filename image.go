@@ -135,6 +135,21 @@ func (i *Image) SetBackgroundColor(color string) *Image {
 	return i
 }
 
+// SetMatteColor sets the color for flattening the transparent image when the output format doesn't support transparency (e.g. JPEG, BMP). The background color will be used if the matte color wasn't setted.
+func (i *Image) SetMatteColor(color string) *Image {
+	i.Output.MatteColor = color
+	return i
+}
+
+// FlattenImage composites the transparent image onto the matte color (or the background color if the matte color wasn't setted), the image becomes opaque. The transparent images will be flattened automatically if the output format doesn't support transparency (e.g. JPEG, BMP).
+func (i *Image) FlattenImage() *Image {
+	i.Output.IsTransparent = false
+	i.addGraph(func(s *ffmpeg.Stream) *ffmpeg.Stream {
+		return flatten(s, i.matteColor())
+	})
+	return i
+}
+
 // SetLoop sets the repeat setting for animated image (e.g. GIF, WebP).
 // - "-1" = no loop
 // - "0" = infinite
@@ -148,9 +163,9 @@ func (i *Image) SetLoop(count int) *Image {
 
 // SetQuality sets the quality for the image from 1 (low quality) to 100 (high quality). Native ffmpeg only works for: AVIF, JPEG, JPEGXL, WEBP.
 //
-// NOTE: for output format as PNG, the pngquant is required to be installed. The function does nothing for PNG if "pngquant" command was not found.
+// NOTE: for output format as PNG, the pngquant is recommended to be installed. The built-in quantizer is used for PNG if "pngquant" command was not found.
 //
-// NOTE: for output format as GIF, the gifsicle is required to be installed. The function does nothing for GIF if "gifsicle" command was not found.
+// NOTE: for output format as GIF, the gifsicle is recommended to be installed. The built-in frame difference and lossy LZW are used for GIF if "gifsicle" command was not found.
 func (i *Image) SetQuality(quality int) *Image {
 	i.Output.Quality = quality
 	return i
@@ -183,10 +198,38 @@ func (i *Image) AddArguments(args map[string]any) *Image {
 	return i
 }
 
+// GetPages returns the page count of the multi-page TIFF image, returns 1 for the other formats.
+func (i *Image) GetPages() int {
+	if i.Stream.CodecName != "tiff" {
+		return 1
+	}
+	data, err := os.ReadFile(i.Path)
+	if err != nil {
+		return 1
+	}
+	pages, err := countTIFFPages(data)
+	if err != nil {
+		return 1
+	}
+	return max(1, pages)
+}
+
+// SelectPage selects the page (starts from 1) of the multi-page TIFF image for the operations, the size of the image will be reloaded.
+func (i *Image) SelectPage(page int) *Image {
+	if i.inputArgs == nil {
+		i.inputArgs = ffmpeg.KwArgs{}
+	}
+	i.inputArgs["page"] = max(1, page)
+	if err := i.loadImageSize(); err != nil {
+		i.err = fmt.Errorf("select page: %w", err)
+	}
+	return i
+}
+
 // SetImageFormat sets the output format and automatically decides the codec. Format will be detect automatically from the output filename if it wasn't been setted.
 func (i *Image) SetImageFormat(format ImageFormat) *Image {
 	switch format {
-	case ImageFormatJPEG, ImageFormatPNG, ImageFormatBMP:
+	case ImageFormatJPEG, ImageFormatPNG, ImageFormatBMP, ImageFormatTIFF, ImageFormatTGA, ImageFormatPPM, ImageFormatPAM, ImageFormatQOI, ImageFormatICO:
 		i.DropFrames()
 	}
 	i.Output.Format = format
@@ -211,12 +254,34 @@ func (i *Image) suffixToFormat(ext string) ImageFormat {
 		return ImageFormatBMP
 	case ".jxl":
 		return ImageFormatJPEGXL
+	case ".tif", ".tiff":
+		return ImageFormatTIFF
+	case ".tga":
+		return ImageFormatTGA
+	case ".ppm":
+		return ImageFormatPPM
+	case ".pam":
+		return ImageFormatPAM
+	case ".qoi":
+		return ImageFormatQOI
+	case ".ico":
+		return ImageFormatICO
+	case ".mp4":
+		return ImageFormatMP4
+	case ".webm":
+		return ImageFormatWebM
 	}
 	return ImageFormatUnknown
 }
 
 // WriteImage writes an image to the specified filename. If the filename parameter is empty string, the image is written to the source file.
 func (i *Image) WriteImage(path string) error {
+	if i.err != nil {
+		return i.err
+	}
+	if path == "" && i.pixels != nil {
+		return fmt.Errorf("no output path for the image from Go's image.Image")
+	}
 	i.Output.Path = path
 	// Write to the input file if output path remains empty.
 	if i.Output.Path == "" {
@@ -233,8 +298,19 @@ func (i *Image) WriteImage(path string) error {
 	if i.Output.Format == ImageFormatUnknown {
 		return fmt.Errorf("unknown output format")
 	}
+	if err := i.checkLosslessJPEG(); err != nil {
+		return fmt.Errorf("lossless jpeg: %w", err)
+	}
 
 	i.buildQuality()
+	i.buildJXL()
+	i.buildWebP()
+	i.buildAVIF()
+	i.buildJPEG()
+	i.buildPNG()
+	i.buildVideo()
+	i.buildTIFF()
+	i.buildICO()
 	i.buildLoop()
 	i.buildBeforeEXIF()
 
@@ -249,19 +325,16 @@ func (i *Image) WriteImage(path string) error {
 		tmpFilename = tmpFile.Name()
 	}
 
-	input := ffmpeg.Input(i.Path)
-
-	for _, v := range i.Output.Filters {
-		input = input.Filter(v.k, v.args)
-	}
+	input := i.buildEvenSize(i.buildPalette(i.buildFlatten(i.buildFilters(i.input()))))
 
 	// `palettegen` and `paletteuse` to keep the transparency for GIF.
 	if i.Output.Format == ImageFormatGIF {
 		split := input.Split()
 		split1, split2 := split.Get("0"), split.Get("1")
+		palettegen, paletteuse := i.gifPaletteArgs()
 
 		input = ffmpeg.Filter([]*ffmpeg.Stream{
-			split1, split2.Filter("palettegen", ffmpeg.Args{})}, "paletteuse", ffmpeg.Args{})
+			split1, split2.Filter("palettegen", palettegen)}, "paletteuse", paletteuse)
 	}
 
 	buf := bytes.NewBuffer(nil)
@@ -281,12 +354,13 @@ func (i *Image) WriteImage(path string) error {
 		color := rgb.Filter("format", ffmpeg.Args{"rgba"})
 
 		// Merge color and alpha
+		colorFmt, alphaFmt := i.avifPixFmt()
 		merged := ffmpeg.Filter([]*ffmpeg.Stream{color, alpha}, "alphamerge", ffmpeg.Args{})
-		merged = merged.Filter("format", ffmpeg.Args{"yuva420p"})
+		merged = merged.Filter("format", ffmpeg.Args{alphaFmt})
 
 		// Split again for output
 		split2 := merged.Split()
-		out1, out2 := split2.Get("0"), split2.Get("1")
+		out1, out2 := split2.Get("0").Filter("format", ffmpeg.Args{colorFmt}), split2.Get("1")
 
 		// Extract alpha from second output
 		outAlpha := out2.Filter("alphaextract", ffmpeg.Args{})
@@ -296,16 +370,19 @@ func (i *Image) WriteImage(path string) error {
 			outputArgs = append(outputArgs,
 				ffmpeg.KwArgs{"frames:v:0": 1},
 				ffmpeg.KwArgs{"frames:v:1": 1},
-				ffmpeg.KwArgs{"still-picture": 1},
 			)
+			// The option is only available for libaom-av1.
+			if i.Output.Codec == string(AVIFEncoderAOM) {
+				outputArgs = append(outputArgs, ffmpeg.KwArgs{"still-picture": 1})
+			}
 		} else if !i.Output.Framerate {
 			outputArgs = append(outputArgs, ffmpeg.KwArgs{"fps_mode": "passthrough"})
 		}
 
 		// Output with both streams
-		err = ffmpeg.Output([]*ffmpeg.Stream{out1, outAlpha}, path, outputArgs...).OverWriteOutput().Silent(i.Silent).WithErrorOutput(buf).Run()
+		err = ffmpeg.Output([]*ffmpeg.Stream{out1, outAlpha}, path, outputArgs...).OverWriteOutput().Silent(i.Silent).WithInput(i.stdin()).WithErrorOutput(buf).Run()
 	} else {
-		err = input.Output(path, i.Output.Args...).OverWriteOutput().Silent(i.Silent).WithErrorOutput(buf).Run()
+		err = input.Output(path, i.Output.Args...).OverWriteOutput().Silent(i.Silent).WithInput(i.stdin()).WithErrorOutput(buf).Run()
 	}
 
 	if err != nil {
@@ -318,7 +395,18 @@ func (i *Image) WriteImage(path string) error {
 		}
 	}
 
-	i.buildAfterQuality()
+	if err := i.buildAfterJXL(); err != nil {
+		return fmt.Errorf("lossless jpeg: %w", err)
+	}
+	if err := i.buildAfterWebP(); err != nil {
+		return fmt.Errorf("webp: %w", err)
+	}
+	if err := i.buildAfterJPEG(); err != nil {
+		return fmt.Errorf("jpeg: %w", err)
+	}
+	if err := i.buildAfterQuality(); err != nil {
+		return fmt.Errorf("optimize: %w", err)
+	}
 	i.buildAfterEXIF()
 
 	if i.isTemp {
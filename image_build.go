@@ -1,64 +1,706 @@
 package ffimage
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"math"
+	"math/bits"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 
 	ffmpeg "github.com/u2takey/ffmpeg-go"
 )
 
+// buildFilters
+func (i *Image) buildFilters(input *ffmpeg.Stream) *ffmpeg.Stream {
+	for _, v := range i.Output.Filters {
+		if v.graph != nil {
+			input = v.graph(input)
+			continue
+		}
+		input = input.Filter(v.k, v.args)
+	}
+	return input
+}
+
+// buildFlatten composites the transparent image onto the matte color for the formats without alpha (e.g. JPEG, BMP).
+func (i *Image) buildFlatten(input *ffmpeg.Stream) *ffmpeg.Stream {
+	if !i.Output.IsTransparent {
+		return input
+	}
+	switch i.Output.Format {
+	case ImageFormatJPEG, ImageFormatBMP, ImageFormatPPM, ImageFormatMP4:
+		return flatten(input, i.matteColor())
+	}
+	return input
+}
+
 // buildQuality
 func (i *Image) buildQuality() *Image {
 	if i.Output.Quality == 0 {
 		return i
 	}
 	switch i.Output.Format {
-	case ImageFormatAVIF:
-		q := qualityFactor(0, 63, i.Output.Quality, true)
-		i.addArg(ffmpeg.KwArgs{"crf": q})
-
 	case ImageFormatJPEG:
 		q := qualityFactor(2, 31, i.Output.Quality, true)
 		i.addArg(ffmpeg.KwArgs{"qscale:v": q})
 
-	case ImageFormatJPEGXL:
-		q := qualityFactor(0, 100, i.Output.Quality, false)
-		i.addArg(ffmpeg.KwArgs{"qscale:v": q})
-
 	case ImageFormatWEBP:
 		q := qualityFactor(0, 100, i.Output.Quality, false)
 		i.addArg(ffmpeg.KwArgs{"quality": q})
+
+	case ImageFormatMP4:
+		q := qualityFactor(17, 51, i.Output.Quality, true)
+		i.addArg(ffmpeg.KwArgs{"crf": q})
+
+	case ImageFormatWebM:
+		q := qualityFactor(0, 63, i.Output.Quality, true)
+		i.addArg(ffmpeg.KwArgs{"crf": q})
+	}
+	return i
+}
+
+// buildJXL
+func (i *Image) buildJXL() *Image {
+	if i.Output.Format != ImageFormatJPEGXL {
+		return i
+	}
+	opts := i.Output.JXL
+	if opts == nil {
+		opts = &JXLOptions{}
+	}
+	switch {
+	case opts.Lossless:
+		i.addArg(ffmpeg.KwArgs{"distance": 0})
+	case opts.Distance > 0:
+		i.addArg(ffmpeg.KwArgs{"distance": fmt.Sprintf("%.2f", math.Max(0.1, math.Min(opts.Distance, 25)))})
+	case i.Output.Quality > 0:
+		i.addArg(ffmpeg.KwArgs{"distance": fmt.Sprintf("%.2f", jxlDistance(i.Output.Quality))})
+	}
+	if opts.Effort > 0 {
+		i.addArg(ffmpeg.KwArgs{"effort": max(1, min(opts.Effort, 9))})
+	}
+	// The animated JPEG XL requires the animation encoder (ffmpeg 7.1 or later), only the first frame is kept by the still encoder.
+	// The frames are passed through so the delay of every frame is kept.
+	if i.GetFrames() > 1 && !i.Output.DropFrames {
+		if !availableEncoders()["libjxl_anim"] {
+			i.addArg(ffmpeg.KwArgs{"frames:v": 1})
+			return i
+		}
+		i.addArg(ffmpeg.KwArgs{"c:v": "libjxl_anim"})
+		if !i.Output.Framerate {
+			i.addArg(ffmpeg.KwArgs{"fps_mode": "passthrough"})
+		}
+	}
+	return i
+}
+
+// checkLosslessJPEG returns the error if JXLOptions.LosslessJPEG is set but the JPEG source can't be recompressed losslessly, so the image won't be re-encoded lossy silently. It must be called before the other build steps since they add the arguments.
+func (i *Image) checkLosslessJPEG() error {
+	if i.Output.Format != ImageFormatJPEGXL || i.Output.JXL == nil || !i.Output.JXL.LosslessJPEG {
+		return nil
+	}
+	if !i.isJXLUntouched() {
+		return fmt.Errorf("the source isn't an untouched JPEG")
+	}
+	if _, err := exec.LookPath("cjxl"); err != nil {
+		return fmt.Errorf("look path: %w", err)
+	}
+	return nil
+}
+
+// buildAfterJXL recompresses the untouched JPEG source losslessly with cjxl. The metadata is removed from the source before the recompression unless it's preserved, since cjxl keeps it.
+func (i *Image) buildAfterJXL() error {
+	if i.Output.Format != ImageFormatJPEGXL || i.Output.JXL == nil || !i.Output.JXL.LosslessJPEG {
+		return nil
+	}
+	source := i.Path
+	if !i.Output.IsPreserved {
+		data, err := os.ReadFile(i.Path)
+		if err != nil {
+			return fmt.Errorf("read: %w", err)
+		}
+		data, err = stripJPEGMetadata(data)
+		if err != nil {
+			return fmt.Errorf("strip metadata: %w", err)
+		}
+		tmpFile, err := os.CreateTemp("", "*.jpg")
+		if err != nil {
+			return fmt.Errorf("create temp: %w", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		if _, err := tmpFile.Write(data); err != nil {
+			tmpFile.Close()
+			return fmt.Errorf("write: %w", err)
+		}
+		if err := tmpFile.Close(); err != nil {
+			return fmt.Errorf("close: %w", err)
+		}
+		source = tmpFile.Name()
+	}
+	args := []string{"--lossless_jpeg=1"}
+	if i.Output.JXL.Effort > 0 {
+		args = append(args, fmt.Sprintf("--effort=%d", max(1, min(i.Output.JXL.Effort, 9))))
+	}
+	// The source is read instead of the output from ffmpeg.
+	return i.execReplace("cjxl", func(_, out string) []string {
+		return append([]string{source, out}, args...)
+	})
+}
+
+// isJXLUntouched reports whether the JPEG source is written as is, so it can be recompressed by cjxl. The source must not be overwritten (the output is the source).
+func (i *Image) isJXLUntouched() bool {
+	opts := i.Output.JXL
+	if i.Stream.CodecName != "mjpeg" || i.Output.Path == i.Path {
+		return false
+	}
+	if opts.Lossless || opts.Distance > 0 || i.Output.Quality > 0 {
+		return false
+	}
+	if i.Output.DropFrames || i.Output.Framerate || i.seek > 0 || i.tileGrid != nil || len(i.inputArgs) > 0 {
+		return false
+	}
+	// The first filter is always the rgba format from NewImage.
+	if len(i.Output.Filters) > 1 {
+		return false
+	}
+	// The only argument is the metadata stripping from NewImage.
+	for _, v := range i.Output.Args {
+		for k := range v {
+			if k != "map_metadata" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// stripJPEGMetadata removes the EXIF, XMP (APP1), IPTC (APP13) and comment segments from the JPEG data, the other segments (e.g. ICC profile, Adobe) and the image data are kept as is.
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, fmt.Errorf("invalid SOI")
+	}
+	out := append(make([]byte, 0, len(data)), data[:2]...)
+	for pos := 2; pos < len(data); {
+		if data[pos] != 0xFF || pos+4 > len(data) {
+			return nil, fmt.Errorf("invalid marker at %d", pos)
+		}
+		marker := data[pos+1]
+		// The entropy-coded data starts after the start of scan.
+		if marker == 0xDA {
+			return append(out, data[pos:]...), nil
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+		if end > len(data) {
+			return nil, fmt.Errorf("truncated segment at %d", pos)
+		}
+		if marker != 0xE1 && marker != 0xED && marker != 0xFE {
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+	}
+	return nil, fmt.Errorf("no SOS found")
+}
+
+// buildWebP
+func (i *Image) buildWebP() *Image {
+	if i.Output.Format != ImageFormatWEBP || i.Output.WebP == nil {
+		return i
+	}
+	opts := i.Output.WebP
+	if opts.Preset != WebPPresetNone {
+		i.addArg(ffmpeg.KwArgs{"preset": string(opts.Preset)})
+	}
+	if opts.Method != nil {
+		i.addArg(ffmpeg.KwArgs{"compression_level": max(0, min(*opts.Method, 6))})
+	}
+	// ffmpeg encodes the lossless image for cwebp to re-encode, near-lossless falls back to lossless without cwebp.
+	if opts.Lossless || opts.NearLossless > 0 || i.isCWebPRequired() {
+		i.addArg(ffmpeg.KwArgs{"lossless": 1})
+	}
+	return i
+}
+
+// isCWebPRequired reports whether the WebP output should be re-encoded by cwebp, since ffmpeg doesn't support near-lossless and alpha quality. Animated images are not supported by cwebp.
+func (i *Image) isCWebPRequired() bool {
+	opts := i.Output.WebP
+	if i.Output.Format != ImageFormatWEBP || opts == nil || (opts.NearLossless <= 0 && opts.AlphaQuality <= 0) {
+		return false
+	}
+	if i.GetFrames() > 1 && !i.Output.DropFrames {
+		return false
+	}
+	_, err := exec.LookPath("cwebp")
+	return err == nil
+}
+
+// buildAfterWebP re-encodes the lossless output from ffmpeg with cwebp, returns the error if cwebp failed.
+func (i *Image) buildAfterWebP() error {
+	if !i.isCWebPRequired() {
+		return nil
+	}
+	opts := i.Output.WebP
+	var args []string
+	// The preset must be the first option of cwebp.
+	if opts.Preset != WebPPresetNone {
+		args = append(args, "-preset", string(opts.Preset))
+	}
+	q := 75
+	if i.Output.Quality > 0 {
+		q = qualityFactor(0, 100, i.Output.Quality, false)
+	}
+	args = append(args, "-q", strconv.Itoa(q))
+	if opts.Method != nil {
+		args = append(args, "-m", strconv.Itoa(max(0, min(*opts.Method, 6))))
+	}
+	if opts.NearLossless > 0 {
+		args = append(args, "-lossless", "-near_lossless", strconv.Itoa(100-min(opts.NearLossless, 100)))
+	} else if opts.Lossless {
+		args = append(args, "-lossless")
+	}
+	if opts.AlphaQuality > 0 {
+		args = append(args, "-alpha_q", strconv.Itoa(max(1, min(opts.AlphaQuality, 100))))
+	}
+	return i.execReplace("cwebp", func(in, out string) []string {
+		return append(args, "-quiet", in, "-o", out)
+	})
+}
+
+// execReplace runs the command which reads the output and writes to a temp file, the output is replaced with the temp file only if the command succeeded.
+func (i *Image) execReplace(name string, args func(in, out string) []string) error {
+	tmpFile, err := os.CreateTemp("", "*"+filepath.Ext(i.Output.Path))
+	if err != nil {
+		return fmt.Errorf("create temp: %w", err)
+	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	if err := exec.Command(name, args(i.Output.Path, tmpFile.Name())...).Run(); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	// Copy instead of rename since the temp directory might be on another device.
+	b, err := os.ReadFile(tmpFile.Name())
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	if err := os.WriteFile(i.Output.Path, b, 0644); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	return nil
+}
+
+// buildJPEG
+func (i *Image) buildJPEG() *Image {
+	if i.Output.Format != ImageFormatJPEG || i.Output.JPEG == nil {
+		return i
+	}
+	switch i.Output.JPEG.Chroma {
+	case JPEGChroma444:
+		i.addArg(ffmpeg.KwArgs{"pix_fmt": "yuvj444p"})
+	case JPEGChroma422:
+		i.addArg(ffmpeg.KwArgs{"pix_fmt": "yuvj422p"})
+	case JPEGChroma420:
+		i.addArg(ffmpeg.KwArgs{"pix_fmt": "yuvj420p"})
 	}
 	return i
 }
 
+// buildPNG
+func (i *Image) buildPNG() *Image {
+	opts := i.Output.PNG
+	if (i.Output.Format != ImageFormatPNG && i.Output.Format != ImageFormatAPNG) || opts == nil {
+		return i
+	}
+	if opts.CompressionLevel > 0 {
+		i.addArg(ffmpeg.KwArgs{"compression_level": min(opts.CompressionLevel, 9)})
+	}
+	if opts.Prediction != PNGPredictionNone {
+		i.addArg(ffmpeg.KwArgs{"pred": string(opts.Prediction)})
+	}
+	if opts.BitDepth == 16 && !opts.Palette {
+		i.keepHighBitDepth()
+		if i.Output.IsTransparent {
+			i.addArg(ffmpeg.KwArgs{"pix_fmt": "rgba64be"})
+		} else {
+			i.addArg(ffmpeg.KwArgs{"pix_fmt": "rgb48be"})
+		}
+	}
+	// The PNG encoder writes Adam7 interlaced image with the interlaced DCT flag.
+	if opts.Interlace {
+		i.addArg(ffmpeg.KwArgs{"flags": "+ildct"})
+	}
+	return i
+}
+
+// keepHighBitDepth replaces the initial rgba format with rgba64le, so the filters run on 16 bits per channel instead of truncating the source to 8 bits before the encoder.
+func (i *Image) keepHighBitDepth() {
+	if len(i.Output.Filters) > 0 && i.Output.Filters[0].k == "format" {
+		i.Output.Filters[0].args = ffmpeg.Args{"rgba64le"}
+	}
+}
+
+// buildPalette reduces the colors of the stream to the palette for the PNG output with the palette option.
+func (i *Image) buildPalette(input *ffmpeg.Stream) *ffmpeg.Stream {
+	opts := i.Output.PNG
+	if (i.Output.Format != ImageFormatPNG && i.Output.Format != ImageFormatAPNG) || opts == nil || !opts.Palette {
+		return input
+	}
+	colors := 256
+	// palettegen only accepts 4 to 256 colors.
+	if opts.Colors > 0 {
+		colors = max(4, min(opts.Colors, 256))
+	}
+	split := input.Split()
+	palette := split.Get("1").Filter("palettegen", ffmpeg.Args{fmt.Sprintf("max_colors=%d", colors)})
+
+	return ffmpeg.Filter([]*ffmpeg.Stream{split.Get("0"), palette}, "paletteuse", ffmpeg.Args{})
+}
+
+// gifPaletteArgs returns the arguments of palettegen and paletteuse from the GIF options.
+func (i *Image) gifPaletteArgs() (palettegen, paletteuse ffmpeg.Args) {
+	opts := i.Output.GIF
+	if opts == nil {
+		return ffmpeg.Args{}, ffmpeg.Args{}
+	}
+	// palettegen only accepts 4 to 256 colors.
+	if opts.MaxColors > 0 {
+		palettegen = append(palettegen, fmt.Sprintf("max_colors=%d", max(4, min(opts.MaxColors, 256))))
+	}
+	if opts.StatsMode != GIFStatsModeNone {
+		palettegen = append(palettegen, fmt.Sprintf("stats_mode=%s", opts.StatsMode))
+	}
+	// paletteuse has to take the new palette of every frame.
+	if opts.StatsMode == GIFStatsModeSingle {
+		paletteuse = append(paletteuse, "new=1")
+	}
+	if opts.Dither != GIFDitherNone {
+		paletteuse = append(paletteuse, fmt.Sprintf("dither=%s", opts.Dither))
+	}
+	if opts.Dither == GIFDitherBayer && opts.BayerScale > 0 {
+		paletteuse = append(paletteuse, fmt.Sprintf("bayer_scale=%d", min(opts.BayerScale, 5)))
+	}
+	if opts.DiffRectangle {
+		paletteuse = append(paletteuse, "diff_mode=rectangle")
+	}
+	if opts.AlphaThreshold > 0 {
+		paletteuse = append(paletteuse, fmt.Sprintf("alpha_threshold=%d", min(opts.AlphaThreshold, 255)))
+	}
+	return palettegen, paletteuse
+}
+
+// buildAfterJPEG rewrites the JPEG losslessly with jpegtran since ffmpeg only encodes the baseline JPEG without restart markers, the output from ffmpeg remains if jpegtran was not found.
+func (i *Image) buildAfterJPEG() error {
+	opts := i.Output.JPEG
+	if i.Output.Format != ImageFormatJPEG || opts == nil || (!opts.Progressive && !opts.Optimize && opts.RestartInterval <= 0) {
+		return nil
+	}
+	if _, err := exec.LookPath("jpegtran"); err != nil {
+		return nil
+	}
+	args := []string{"-copy", "all"}
+	if opts.Optimize {
+		args = append(args, "-optimize")
+	}
+	if opts.Progressive {
+		args = append(args, "-progressive")
+	}
+	if opts.RestartInterval > 0 {
+		args = append(args, "-restart", strconv.Itoa(opts.RestartInterval))
+	}
+	return i.execReplace("jpegtran", func(in, out string) []string {
+		return append(args, "-outfile", out, in)
+	})
+}
+
+// buildAVIF selects the available AV1 encoder and sets the options of the encoder.
+func (i *Image) buildAVIF() *Image {
+	if i.Output.Format != ImageFormatAVIF {
+		return i
+	}
+	opts := i.Output.AVIF
+	if opts == nil {
+		opts = &AVIFOptions{}
+	}
+	if opts.BitDepth >= 10 {
+		i.keepHighBitDepth()
+	}
+	encoder := selectAVIFEncoder(opts.Encoder, opts.Lossless, availableEncoders())
+	i.Output.Codec = string(encoder)
+	i.addArg(ffmpeg.KwArgs{"c:v": string(encoder)})
+	if i.GetFrames() > 1 && !i.Output.DropFrames {
+		if opts.KeyframeInterval > 0 {
+			i.addArg(ffmpeg.KwArgs{"g": opts.KeyframeInterval})
+		}
+		if opts.Timescale > 0 {
+			i.addArg(ffmpeg.KwArgs{"video_track_timescale": opts.Timescale})
+		}
+	}
+
+	switch encoder {
+	case AVIFEncoderAOM:
+		if opts.Speed > 0 {
+			i.addArg(ffmpeg.KwArgs{"cpu-used": int(math.Round(float64(min(opts.Speed, 10)-1) * 8 / 9))})
+		}
+		if opts.TileColumns > 1 || opts.TileRows > 1 {
+			i.addArg(ffmpeg.KwArgs{"tiles": fmt.Sprintf("%dx%d", max(1, opts.TileColumns), max(1, opts.TileRows))})
+		}
+		if opts.Lossless {
+			i.addArg(ffmpeg.KwArgs{"lossless": 1})
+		} else if i.Output.Quality > 0 {
+			i.addArg(ffmpeg.KwArgs{"crf": qualityFactor(0, 63, i.Output.Quality, true)})
+		}
+
+	case AVIFEncoderSVT:
+		if opts.Speed > 0 {
+			i.addArg(ffmpeg.KwArgs{"preset": int(math.Round(float64(min(opts.Speed, 10)-1) * 13 / 9))})
+		}
+		if opts.TileColumns > 1 || opts.TileRows > 1 {
+			// The tiles of libsvtav1 are in log2.
+			i.addArg(ffmpeg.KwArgs{"svtav1-params": fmt.Sprintf("tile-columns=%d:tile-rows=%d", bits.Len(uint(max(1, opts.TileColumns)))-1, bits.Len(uint(max(1, opts.TileRows)))-1)})
+		}
+		if i.Output.Quality > 0 {
+			i.addArg(ffmpeg.KwArgs{"crf": qualityFactor(0, 63, i.Output.Quality, true)})
+		}
+
+	case AVIFEncoderRav1e:
+		if opts.Speed > 0 {
+			i.addArg(ffmpeg.KwArgs{"speed": min(opts.Speed, 10)})
+		}
+		if opts.TileColumns > 1 {
+			i.addArg(ffmpeg.KwArgs{"tile-columns": opts.TileColumns})
+		}
+		if opts.TileRows > 1 {
+			i.addArg(ffmpeg.KwArgs{"tile-rows": opts.TileRows})
+		}
+		if opts.Lossless {
+			i.addArg(ffmpeg.KwArgs{"qp": 0})
+		} else if i.Output.Quality > 0 {
+			i.addArg(ffmpeg.KwArgs{"qp": qualityFactor(0, 255, i.Output.Quality, true)})
+		}
+	}
+	return i
+}
+
+// avifPixFmt returns the pixel formats of the color and the alpha with the chroma subsampling and the bit depth of the AVIF options.
+func (i *Image) avifPixFmt() (color, alpha string) {
+	opts := i.Output.AVIF
+	if opts == nil {
+		return "yuv420p", "yuva420p"
+	}
+	chroma := "420"
+	// libsvtav1 only supports 420.
+	if (opts.Chroma == AVIFChroma444 || opts.Lossless) && i.Output.Codec != string(AVIFEncoderSVT) {
+		chroma = "444"
+	}
+	depth := ""
+	if opts.BitDepth >= 10 {
+		depth = "10le"
+	}
+	return fmt.Sprintf("yuv%sp%s", chroma, depth), fmt.Sprintf("yuva%sp%s", chroma, depth)
+}
+
+// selectAVIFEncoder returns the preferred encoder if it's available, otherwise the first available encoder in the order of libaom-av1, libsvtav1 and librav1e. The preferred encoder is returned if there's no encoder available.
+func selectAVIFEncoder(preferred AVIFEncoder, isLossless bool, available map[string]bool) AVIFEncoder {
+	if preferred == AVIFEncoderNone {
+		preferred = AVIFEncoderAOM
+	}
+	for _, v := range []AVIFEncoder{preferred, AVIFEncoderAOM, AVIFEncoderSVT, AVIFEncoderRav1e} {
+		// libsvtav1 doesn't support lossless.
+		if isLossless && v == AVIFEncoderSVT {
+			continue
+		}
+		if available[string(v)] {
+			return v
+		}
+	}
+	return preferred
+}
+
+var encoders struct {
+	once  sync.Once
+	names map[string]bool
+}
+
+// availableEncoders returns the names of the encoders compiled in ffmpeg, the result is cached.
+func availableEncoders() map[string]bool {
+	encoders.once.Do(func() {
+		encoders.names = make(map[string]bool)
+		b, err := exec.Command("ffmpeg", "-hide_banner", "-encoders").Output()
+		if err != nil {
+			return
+		}
+		// The encoder lines are like " V....D libaom-av1           libaom AV1 (codec av1)".
+		for _, line := range strings.Split(string(b), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && len(fields[0]) == 6 {
+				encoders.names[fields[1]] = true
+			}
+		}
+	})
+	return encoders.names
+}
+
+// buildTIFF
+func (i *Image) buildTIFF() *Image {
+	if i.Output.Format != ImageFormatTIFF || i.Output.TIFF == nil || i.Output.TIFF.Compression == TIFFCompressionNone {
+		return i
+	}
+	i.addArg(ffmpeg.KwArgs{"compression_algo": string(i.Output.TIFF.Compression)})
+	return i
+}
+
+// buildICO fits the image into 256x256 since it's the largest size of the ICO format, use FaviconSet for the multi-resolution icons.
+func (i *Image) buildICO() *Image {
+	if i.Output.Format != ImageFormatICO || (i.Width <= 256 && i.Height <= 256) {
+		return i
+	}
+	w, h := i.calcBestpad(i.Width, i.Height, 256, 256)
+	i.setWidthHeight(max(1, w), max(1, h))
+	i.addFilter("scale", ffmpeg.Args{fmt.Sprintf("%d:%d", i.Width, i.Height)})
+	return i
+}
+
+// countTIFFPages counts the image file directories (pages) of the TIFF data, returns the error if the data isn't a classic TIFF (BigTIFF isn't supported), an IFD is truncated or the IFDs are cyclic.
+func countTIFFPages(data []byte) (int, error) {
+	if len(data) < 8 {
+		return 0, fmt.Errorf("truncated header")
+	}
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, fmt.Errorf("invalid byte order: %q", data[:2])
+	}
+	if magic := order.Uint16(data[2:4]); magic != 42 {
+		return 0, fmt.Errorf("invalid magic: %d", magic)
+	}
+	visited := make(map[uint32]bool)
+	var pages int
+	for offset := order.Uint32(data[4:8]); offset != 0; pages++ {
+		if visited[offset] {
+			return 0, fmt.Errorf("cyclic IFD at offset %d", offset)
+		}
+		visited[offset] = true
+		if int(offset)+2 > len(data) {
+			return 0, fmt.Errorf("truncated IFD at offset %d", offset)
+		}
+		next := int(offset) + 2 + int(order.Uint16(data[offset:]))*12
+		if next+4 > len(data) {
+			return 0, fmt.Errorf("truncated IFD at offset %d", offset)
+		}
+		offset = order.Uint32(data[next:])
+	}
+	return pages, nil
+}
+
 // buildLoop
 func (i *Image) buildLoop() *Image {
 	if i.Output.Format == ImageFormatAPNG {
 		i.addArg(ffmpeg.KwArgs{"plays": i.Output.Loop})
+	} else if i.Output.Format == ImageFormatAVIF {
+		// The loop of AVIF is the play count, 0 is infinite.
+		i.addArg(ffmpeg.KwArgs{"loop": avifLoop(i.Output.Loop)})
+	} else if i.Output.Format == ImageFormatMP4 || i.Output.Format == ImageFormatWebM {
+		// The videos can't loop by themselves, the source is read again for the finite loop count. Use the "loop" attribute of <video> for the infinite loop.
+		if frames := i.GetFrames(); i.Output.Loop > 0 && frames > 1 && !i.Output.DropFrames {
+			if i.pixels == nil {
+				i.streamLoop = i.Output.Loop
+			} else {
+				// The piped input can't be read again, the frames are kept in memory and repeated instead.
+				i.addFilter("loop", ffmpeg.Args{fmt.Sprintf("loop=%d:size=%d", i.Output.Loop, frames)})
+			}
+		}
 	} else {
 		i.addArg(ffmpeg.KwArgs{"loop": i.Output.Loop})
 	}
 	return i
 }
 
-// buildAfterQuality
-func (i *Image) buildAfterQuality() *Image {
-	if i.Output.Quality == 0 {
+// buildVideo sets the codec of the MP4 (H.264) and WebM (VP9 with alpha) output, the audio is removed.
+func (i *Image) buildVideo() *Image {
+	switch i.Output.Format {
+	case ImageFormatMP4:
+		i.addArg(ffmpeg.KwArgs{"c:v": "libx264", "pix_fmt": "yuv420p", "movflags": "+faststart", "an": ""})
+	case ImageFormatWebM:
+		// VP9 requires zero bitrate for the constant quality mode.
+		i.addArg(ffmpeg.KwArgs{"c:v": "libvpx-vp9", "pix_fmt": "yuva420p", "b:v": 0, "an": ""})
+		if i.Output.Quality == 0 {
+			i.addArg(ffmpeg.KwArgs{"crf": 31})
+		}
+	default:
 		return i
 	}
+	// Keep the delay of every frame instead of duplicating the frames to the constant framerate.
+	if !i.Output.Framerate {
+		i.addArg(ffmpeg.KwArgs{"fps_mode": "vfr"})
+	}
+	return i
+}
+
+// buildEvenSize pads the stream to the even size with the matte color for the MP4 output, since yuv420p requires the even width and height.
+func (i *Image) buildEvenSize(input *ffmpeg.Stream) *ffmpeg.Stream {
+	if i.Output.Format != ImageFormatMP4 || (i.Width%2 == 0 && i.Height%2 == 0) {
+		return input
+	}
+	return input.Filter("pad", ffmpeg.Args{fmt.Sprintf("%d:%d:0:0:%s", i.Width+i.Width%2, i.Height+i.Height%2, opaqueColor(i.matteColor()))})
+}
+
+// avifLoop converts the loop count of SetLoop to the play count of AVIF.
+func avifLoop(loop int) int {
+	switch {
+	case loop < 0:
+		return 1
+	case loop == 0:
+		return 0
+	}
+	return loop + 1
+}
+
+// buildAfterQuality optimizes the PNG or GIF output with the tool, the built-in optimizer is used if the tool was not found or failed.
+func (i *Image) buildAfterQuality() error {
+	if i.Output.Quality == 0 {
+		return nil
+	}
 	switch i.Output.Format {
 	case ImageFormatPNG:
 		q := qualityFactor(0, 100, i.Output.Quality, false)
-		exec.Command("pngquant", "--quality", fmt.Sprintf("0-%d", q), "-f", i.Output.Path, "-o", i.Output.Path).Run()
+		if err := exec.Command("pngquant", "--quality", fmt.Sprintf("0-%d", q), "-f", i.Output.Path, "-o", i.Output.Path).Run(); err == nil {
+			i.Output.Optimizer = OptimizerPNGQuant
+			return nil
+		}
+		// The output remains if it's already a palette image or the quantized image is larger.
+		ok, err := quantizePNG(i.Output.Path, q)
+		if err != nil {
+			return fmt.Errorf("quantize png: %w", err)
+		}
+		if ok {
+			i.Output.Optimizer = OptimizerBuiltin
+		}
 
 	case ImageFormatGIF:
 		q := qualityFactor(0, 100, i.Output.Quality, false)
-		exec.Command("gifsicle", "-O3", fmt.Sprintf("--lossy=%d", q), i.Output.Path, "-o", i.Output.Path).Run()
+		if err := exec.Command("gifsicle", "-O3", fmt.Sprintf("--lossy=%d", q), i.Output.Path, "-o", i.Output.Path).Run(); err == nil {
+			i.Output.Optimizer = OptimizerGifsicle
+			return nil
+		}
+		// The output remains if it's a static image, it can't be optimized or the optimized image is larger.
+		ok, err := optimizeGIF(i.Output.Path, q)
+		if err != nil {
+			return fmt.Errorf("optimize gif: %w", err)
+		}
+		if ok {
+			i.Output.Optimizer = OptimizerBuiltin
+		}
 	}
-	return i
+	return nil
 }
 
 // buildBeforeEXIF
@@ -0,0 +1,230 @@
+package ffimage
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// ModulateImage controls the brightness, saturation and hue of the image in percentages, 100 means unchanged.
+//
+// - brightness: 0 is black, 200 is white.
+//
+// - saturation: 0 is grayscale, 200 doubles the saturation.
+//
+// - hue: 0 and 200 rotates the hue by 180 degrees.
+func (i *Image) ModulateImage(brightness, saturation, hue int) *Image {
+	if brightness != 100 {
+		b := math.Max(-1, math.Min(float64(brightness-100)/100, 1))
+		i.addGraph(func(s *ffmpeg.Stream) *ffmpeg.Stream {
+			return keepAlpha(s, "eq", ffmpeg.Args{fmt.Sprintf("brightness=%.2f", b)})
+		})
+	}
+	if saturation != 100 || hue != 100 {
+		h := float64(hue-100) * 1.8
+		sat := math.Max(0, math.Min(float64(saturation)/100, 10))
+		i.addFilter("hue", ffmpeg.Args{fmt.Sprintf("h=%.2f:s=%.2f", h, sat)})
+	}
+	return i
+}
+
+// ContrastImage changes the contrast of the image, 1 means unchanged, 0 is flat gray and higher value increases the contrast.
+func (i *Image) ContrastImage(contrast float64) *Image {
+	contrast = math.Max(-1000, math.Min(contrast, 1000))
+	i.addGraph(func(s *ffmpeg.Stream) *ffmpeg.Stream {
+		return keepAlpha(s, "eq", ffmpeg.Args{fmt.Sprintf("contrast=%.2f", contrast)})
+	})
+	return i
+}
+
+// GammaImage gamma-corrects the image from 0.1 to 10, 1 means unchanged, lower value darkens the image.
+func (i *Image) GammaImage(gamma float64) *Image {
+	gamma = math.Max(0.1, math.Min(gamma, 10))
+	i.addGraph(func(s *ffmpeg.Stream) *ffmpeg.Stream {
+		return keepAlpha(s, "eq", ffmpeg.Args{fmt.Sprintf("gamma=%.2f", gamma)})
+	})
+	return i
+}
+
+// GrayscaleImage converts the image to grayscale, the alpha channel will be kept.
+func (i *Image) GrayscaleImage() *Image {
+	i.addFilter("hue", ffmpeg.Args{"s=0"})
+	return i
+}
+
+// SepiaImage applies the sepia tone to the image.
+func (i *Image) SepiaImage() *Image {
+	i.addFilter("colorchannelmixer", ffmpeg.Args{".393:.769:.189:0:.349:.686:.168:0:.272:.534:.131"})
+	return i
+}
+
+// TintImage colorizes the image with the given color, the amount is from 0 (no effect) to 1 (fully colorized). Only hex colors are supported (e.g. "#FF9900", "0xFF9900"), the function does nothing if the color can't be parsed.
+func (i *Image) TintImage(color string, amount float64) *Image {
+	r, g, b, ok := parseHexColor(color)
+	if !ok || amount <= 0 {
+		return i
+	}
+	h, s, l := rgbToHSL(r, g, b)
+	i.addFilter("colorize", ffmpeg.Args{fmt.Sprintf("hue=%.2f:saturation=%.2f:lightness=%.2f:mix=%.2f", h, s, l, math.Min(amount, 1))})
+	return i
+}
+
+// ApplyLUT applies the color grading from a 3D LUT file (e.g. ".cube", ".3dl") or a Hald CLUT image (".png") to every frame of the image. The intensity is from 0 (no effect) to 1 (fully graded) and blends the graded image with the original.
+func (i *Image) ApplyLUT(path string, intensity float64) *Image {
+	if intensity <= 0 {
+		return i
+	}
+	intensity = math.Min(intensity, 1)
+
+	i.addGraph(func(s *ffmpeg.Stream) *ffmpeg.Stream {
+		var original *ffmpeg.Stream
+		if intensity < 1 {
+			split := s.Split()
+			s, original = split.Get("0"), split.Get("1")
+		}
+		if strings.ToLower(filepath.Ext(path)) == ".png" {
+			s = ffmpeg.Filter([]*ffmpeg.Stream{s, ffmpeg.Input(path)}, "haldclut", ffmpeg.Args{})
+		} else {
+			s = s.Filter("lut3d", ffmpeg.Args{fmt.Sprintf("file=%s", escapeFilterValue(path))})
+		}
+		if original == nil {
+			return s
+		}
+		return ffmpeg.Filter([]*ffmpeg.Stream{s, original}, "blend", ffmpeg.Args{fmt.Sprintf("all_mode=normal:all_opacity=%.2f", intensity)})
+	})
+	return i
+}
+
+// Levels is the black and white points of the red, green and blue channels from 0 to 255.
+type Levels struct {
+	Black [3]int
+	White [3]int
+}
+
+// NormalizeImage stretches the colors of every frame to the full range with the normalize filter.
+func (i *Image) NormalizeImage() *Image {
+	i.addFilter("normalize", ffmpeg.Args{"blackpt=black:whitept=white:smoothing=0:independence=1:strength=1"})
+	return i
+}
+
+// EqualizeImage equalizes the histogram of every frame with the histeq filter.
+func (i *Image) EqualizeImage() *Image {
+	i.addFilter("histeq", ffmpeg.Args{})
+	return i
+}
+
+// AutoLevels analyzes the first frame of the current image and stretches the colors to the full range, the darkest and brightest "clipPercent" (e.g. 0.5) of the pixels will be clipped. The computed levels can be read from Output.Levels after calling the function.
+//
+// NOTE: WriteImage returns the error if the analysis was failed.
+func (i *Image) AutoLevels(clipPercent float64) *Image {
+	levels, err := i.AnalyzeLevels(clipPercent)
+	if err != nil {
+		i.err = fmt.Errorf("auto levels: %w", err)
+		return i
+	}
+	i.Output.Levels = levels
+
+	var args []string
+	for k, c := range []string{"r", "g", "b"} {
+		args = append(args, fmt.Sprintf("%simin=%.4f:%simax=%.4f", c, float64(levels.Black[k])/255, c, float64(levels.White[k])/255))
+	}
+	i.addFilter("colorlevels", ffmpeg.Args{strings.Join(args, ":")})
+	return i
+}
+
+// AnalyzeLevels computes the black and white points of the first frame of the current image (with the applied operations), the darkest and brightest "clipPercent" (e.g. 0.5) of the pixels will be clipped. Transparent pixels are ignored.
+func (i *Image) AnalyzeLevels(clipPercent float64) (*Levels, error) {
+	buf, errBuf := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+	err := i.buildFilters(i.input()).
+		Filter("format", ffmpeg.Args{"rgba"}).
+		Output("pipe:", ffmpeg.KwArgs{"frames:v": 1, "f": "rawvideo"}).
+		Silent(i.Silent).WithInput(i.stdin()).WithOutput(buf).WithErrorOutput(errBuf).Run()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg output: %s", errBuf.String())
+	}
+	return calcLevels(buf.Bytes(), clipPercent), nil
+}
+
+// calcLevels
+func calcLevels(rgba []byte, clipPercent float64) *Levels {
+	var hist [3][256]int
+	var total int
+
+	for p := 0; p+3 < len(rgba); p += 4 {
+		if rgba[p+3] == 0 {
+			continue
+		}
+		for c := 0; c < 3; c++ {
+			hist[c][rgba[p+c]]++
+		}
+		total++
+	}
+	clip := int(float64(total) * clipPercent / 100)
+	levels := &Levels{}
+
+	for c := 0; c < 3; c++ {
+		black, white := 0, 255
+		for sum := 0; black < 255; black++ {
+			if sum += hist[c][black]; sum > clip {
+				break
+			}
+		}
+		for sum := 0; white > 0; white-- {
+			if sum += hist[c][white]; sum > clip {
+				break
+			}
+		}
+		if black >= white {
+			black, white = 0, 255
+		}
+		levels.Black[c], levels.White[c] = black, white
+	}
+	return levels
+}
+
+// parseHexColor
+func parseHexColor(color string) (r, g, b uint8, ok bool) {
+	color = strings.TrimPrefix(strings.TrimPrefix(color, "#"), "0x")
+	if len(color) != 6 && len(color) != 8 {
+		return 0, 0, 0, false
+	}
+	v, err := strconv.ParseUint(color[:6], 16, 32)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	return uint8(v >> 16), uint8(v >> 8), uint8(v), true
+}
+
+// rgbToHSL converts the color to hue (0 to 360), saturation (0 to 1) and lightness (0 to 1).
+func rgbToHSL(r, g, b uint8) (h, s, l float64) {
+	fr, fg, fb := float64(r)/255, float64(g)/255, float64(b)/255
+	maxC, minC := math.Max(fr, math.Max(fg, fb)), math.Min(fr, math.Min(fg, fb))
+	l = (maxC + minC) / 2
+
+	if maxC == minC {
+		return 0, 0, l
+	}
+	d := maxC - minC
+	if l > 0.5 {
+		s = d / (2 - maxC - minC)
+	} else {
+		s = d / (maxC + minC)
+	}
+	switch maxC {
+	case fr:
+		h = (fg - fb) / d
+		if fg < fb {
+			h += 6
+		}
+	case fg:
+		h = (fb-fr)/d + 2
+	case fb:
+		h = (fr-fg)/d + 4
+	}
+	return h * 60, s, l
+}
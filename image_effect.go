@@ -0,0 +1,263 @@
+package ffimage
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// BlurImage applies gaussian blur to the image, the sigma is the standard deviation in pixels of the current image size.
+func (i *Image) BlurImage(sigma float64) *Image {
+	if sigma <= 0 {
+		return i
+	}
+	i.addFilter("gblur", ffmpeg.Args{fmt.Sprintf("sigma=%.2f", sigma)})
+	return i
+}
+
+// SharpenImage sharpens the image with the smartblur filter. The amount is from 0 (no effect) to 1 (strongest), the radius is in pixels of the current image size from 0.1 to 5, only the edges (the pixels that differ from their neighbours more than the threshold from 0 to 30) will be sharpened, 0 sharpens every pixel. The alpha is kept as is.
+func (i *Image) SharpenImage(amount, radius float64, threshold int) *Image {
+	if amount <= 0 {
+		return i
+	}
+	amount = math.Min(amount, 1)
+	radius = math.Max(0.1, math.Min(radius, 5))
+	threshold = max(0, min(threshold, 30))
+
+	// The negative threshold of smartblur filters the edges, the positive one filters the flat areas.
+	i.addGraph(func(s *ffmpeg.Stream) *ffmpeg.Stream {
+		return keepAlpha(s, "smartblur", ffmpeg.Args{fmt.Sprintf("lr=%.2f:ls=%.2f:lt=%d", radius, -amount, -threshold)})
+	})
+	return i
+}
+
+// UnsharpMask sharpens the image with the unsharp filter. The radius is in pixels of the current image size, the amount is from 0 (no effect) to 5 (strongest), negative amount blurs the image.
+func (i *Image) UnsharpMask(radius, amount float64) *Image {
+	if amount == 0 {
+		return i
+	}
+	amount = math.Max(-2, math.Min(amount, 5))
+	size := i.kernelSize(radius)
+
+	i.addFilter("unsharp", ffmpeg.Args{fmt.Sprintf("lx=%d:ly=%d:la=%.2f:cx=%d:cy=%d:ca=%.2f", size, size, amount, size, size, amount)})
+	return i
+}
+
+// kernelSize converts the radius to an odd matrix size between 3 and 23 which doesn't exceed the current image size.
+func (i *Image) kernelSize(radius float64) int {
+	size := int(math.Round(radius))*2 + 1
+	size = min(size, 23, i.Width, i.Height)
+	if size%2 == 0 {
+		size--
+	}
+	return max(size, 3)
+}
+
+// RoundCorners makes the corners of the image transparent with the given radius in pixels of the current image size. The corners will be filled with the background color (black as default, can be set with SetBackgroundColor) if the output format doesn't support transparency (e.g. JPEG, BMP).
+func (i *Image) RoundCorners(radius int) *Image {
+	if radius <= 0 {
+		return i
+	}
+	i.addMask(fmt.Sprintf("lte(hypot(X-clip(X,%[1]d,W-%[1]d),Y-clip(Y,%[1]d,H-%[1]d)),%[1]d)", radius))
+	return i
+}
+
+// CircleMask makes the area outside of the inscribed circle of the image transparent, use CropThumbnailImage before for square avatars. The area will be filled with the background color (black as default, can be set with SetBackgroundColor) if the output format doesn't support transparency (e.g. JPEG, BMP).
+func (i *Image) CircleMask() *Image {
+	i.addMask("lte(hypot(X-W/2,Y-H/2),min(W,H)/2)")
+	return i
+}
+
+// addMask multiplies the alpha of the image with the expression of the geq filter, the pixel is kept if the expression returns 1 and transparent if 0.
+func (i *Image) addMask(expr string) {
+	i.Output.IsTransparent = true
+	i.addGraph(func(s *ffmpeg.Stream) *ffmpeg.Stream {
+		split := s.Split()
+		color, alpha := split.Get("0"), split.Get("1")
+
+		mask := alpha.Filter("alphaextract", ffmpeg.Args{}).Filter("geq", ffmpeg.Args{fmt.Sprintf("lum=lum(X,Y)*%s", expr)})
+		return ffmpeg.Filter([]*ffmpeg.Stream{color, mask}, "alphamerge", ffmpeg.Args{})
+	})
+}
+
+// BorderImage surrounds the image with a border of the given width and color, the image size grows by the border width on each side.
+func (i *Image) BorderImage(width int, color string) *Image {
+	return i.FrameImage(width, color, FrameTypeOuter)
+}
+
+// FrameImage draws a frame of the given width and color around the image.
+//
+// - FrameTypeOuter: The frame is drawn outside of the image, the image size grows by the frame width on each side.
+//
+// - FrameTypeInner: The frame is drawn over the edges of the image, the image size remains unchanged.
+func (i *Image) FrameImage(width int, color string, typ FrameType) *Image {
+	if width <= 0 {
+		return i
+	}
+	switch typ {
+	case FrameTypeOuter:
+		w, h := i.Width+width*2, i.Height+width*2
+		i.setWidthHeight(w, h)
+		i.addFilter("pad", ffmpeg.Args{fmt.Sprintf("%d:%d:%d:%d:%s", w, h, width, width, color)})
+	case FrameTypeInner:
+		i.addFilter("drawbox", ffmpeg.Args{fmt.Sprintf("0:0:iw:ih:%s:t=%d", color, width)})
+	}
+	return i
+}
+
+// DropShadow casts a shadow behind the image, the shadow follows the shape of the transparent image. The canvas grows to fit the shadow with the offsets and the blur, the extended area is transparent (or filled with the background color for the formats without alpha). The color only supports hex colors (e.g. "#000000") and falls back to black, the opacity is from 0 to 1.
+func (i *Image) DropShadow(offsetX, offsetY int, blur float64, color string, opacity float64) *Image {
+	r, g, b, ok := parseHexColor(color)
+	if !ok {
+		r, g, b = 0, 0, 0
+	}
+	opacity = math.Max(0, math.Min(opacity, 1))
+	// Reserve 3 sigma for the blur so the shadow won't be cut off.
+	margin := int(math.Ceil(math.Max(blur, 0) * 3))
+
+	w := i.Width + int(math.Abs(float64(offsetX))) + margin*2
+	h := i.Height + int(math.Abs(float64(offsetY))) + margin*2
+	x, y := margin+max(0, -offsetX), margin+max(0, -offsetY)
+
+	i.setWidthHeight(w, h)
+	i.Output.IsTransparent = true
+	i.addGraph(func(s *ffmpeg.Stream) *ffmpeg.Stream {
+		split := s.Split()
+		img, shadow := split.Get("0"), split.Get("1")
+
+		shadow = shadow.
+			Filter("lutrgb", ffmpeg.Args{fmt.Sprintf("r=%d:g=%d:b=%d:a=val*%.2f", r, g, b, opacity)}).
+			Filter("pad", ffmpeg.Args{fmt.Sprintf("%d:%d:%d:%d:black@0", w, h, x+offsetX, y+offsetY)})
+		if blur > 0 {
+			shadow = shadow.Filter("gblur", ffmpeg.Args{fmt.Sprintf("sigma=%.2f", blur)})
+		}
+		return shadow.Overlay(img, "", ffmpeg.KwArgs{"x": x, "y": y, "format": "auto"})
+	})
+	return i
+}
+
+// RedactRegions hides the regions (e.g. faces, license plates) of every frame, the coordinates are in pixels of the current image size and will be clipped to the image.
+//
+// - RedactModePixelate: The regions are pixelated, every block is filled with its average color.
+//
+// - RedactModeBlur: The regions are blurred.
+//
+// - RedactModeFill: The regions are filled with the background color (black as default, can be set with SetBackgroundColor).
+func (i *Image) RedactRegions(rects []Rect, mode RedactMode) *Image {
+	for _, v := range rects {
+		r, ok := i.clipRect(v)
+		if !ok {
+			continue
+		}
+		switch mode {
+		case RedactModeFill:
+			i.addFilter("drawbox", ffmpeg.Args{fmt.Sprintf("%d:%d:%d:%d:%s@1:t=fill", r.X, r.Y, r.Width, r.Height, opaqueColor(i.Output.BackgroundColor))})
+
+		case RedactModePixelate, RedactModeBlur:
+			i.addGraph(func(s *ffmpeg.Stream) *ffmpeg.Stream {
+				split := s.Filter("format", ffmpeg.Args{"rgba"}).Split()
+				base, alpha := split.Get("0"), split.Get("1").Filter("alphaextract", ffmpeg.Args{})
+				// The region is made opaque so the original pixels don't show through the semi-transparent area when overlaid, the original alpha is merged back afterwards.
+				region := split.Get("2").
+					Filter("crop", ffmpeg.Args{fmt.Sprintf("%d:%d:%d:%d", r.Width, r.Height, r.X, r.Y)}).
+					Filter("format", ffmpeg.Args{"rgb24"})
+
+				if mode == RedactModePixelate {
+					block := max(2, min(r.Width, r.Height)/8)
+					region = region.
+						Filter("scale", ffmpeg.Args{fmt.Sprintf("%d:%d:flags=area", max(1, r.Width/block), max(1, r.Height/block))}).
+						Filter("scale", ffmpeg.Args{fmt.Sprintf("%d:%d:flags=neighbor", r.Width, r.Height)})
+				} else {
+					region = region.Filter("gblur", ffmpeg.Args{fmt.Sprintf("sigma=%.2f", math.Max(2, float64(min(r.Width, r.Height))/6))})
+				}
+				color := base.Overlay(region, "", ffmpeg.KwArgs{"x": r.X, "y": r.Y, "format": "auto"})
+				return ffmpeg.Filter([]*ffmpeg.Stream{color, alpha}, "alphamerge", ffmpeg.Args{})
+			})
+		}
+	}
+	return i
+}
+
+// clipRect clips the rect to the current image size, returns false if the rect is outside of the image.
+func (i *Image) clipRect(r Rect) (Rect, bool) {
+	x1, y1 := max(0, r.X), max(0, r.Y)
+	x2, y2 := min(i.Width, r.X+r.Width), min(i.Height, r.Y+r.Height)
+	if x2 <= x1 || y2 <= y1 {
+		return Rect{}, false
+	}
+	return Rect{X: x1, Y: y1, Width: x2 - x1, Height: y2 - y1}, true
+}
+
+// ConvolveImage applies the convolution kernel to the color of every frame, the kernel must be a square matrix of size 3, 5 or 7. The result of each pixel is divided by the divisor and then the bias (0 to 255) is added. The function does nothing if the kernel is invalid.
+func (i *Image) ConvolveImage(kernel [][]float64, divisor, bias float64) *Image {
+	matrix, rdiv, ok := convolutionMatrix(kernel, divisor)
+	if !ok {
+		return i
+	}
+	var args []string
+	for p := 0; p < 3; p++ {
+		args = append(args, fmt.Sprintf("%[1]dm=%[2]s:%[1]drdiv=%[3]g:%[1]dbias=%[4]g", p, matrix, rdiv, bias))
+	}
+	i.addFilter("format", ffmpeg.Args{"gbrap"})
+	i.addFilter("convolution", ffmpeg.Args{strings.Join(args, ":")})
+	return i
+}
+
+// EdgeDetectImage keeps the edges of the image as white lines on black with the edgedetect filter.
+func (i *Image) EdgeDetectImage() *Image {
+	i.addGraph(func(s *ffmpeg.Stream) *ffmpeg.Stream {
+		return keepAlpha(s, "edgedetect", ffmpeg.Args{"mode=wires"})
+	})
+	return i
+}
+
+// OutlineImage keeps the edges of the image as black lines on white with the edgedetect filter, which is useful for line-art previews.
+func (i *Image) OutlineImage() *Image {
+	i.EdgeDetectImage()
+	i.addFilter("negate", ffmpeg.Args{"negate_alpha=0"})
+	return i
+}
+
+// EmbossImage makes the image look like it's embossed, the flat areas become gray.
+func (i *Image) EmbossImage() *Image {
+	return i.ConvolveImage([][]float64{
+		{-2, -1, 0},
+		{-1, 1, 1},
+		{0, 1, 2},
+	}, 1, 128)
+}
+
+// convolutionMatrix converts the kernel to the matrix of the convolution filter. The matrix only accepts integers, so the kernel is scaled up until all the values are integers and the scale is compensated in the returned rdiv.
+func convolutionMatrix(kernel [][]float64, divisor float64) (matrix string, rdiv float64, ok bool) {
+	size := len(kernel)
+	if (size != 3 && size != 5 && size != 7) || divisor == 0 {
+		return "", 0, false
+	}
+	scale := 1.0
+	for ; scale < 10000; scale *= 10 {
+		isInteger := true
+		for _, row := range kernel {
+			for _, v := range row {
+				if v*scale != math.Round(v*scale) {
+					isInteger = false
+				}
+			}
+		}
+		if isInteger {
+			break
+		}
+	}
+	values := make([]string, 0, size*size)
+	for _, row := range kernel {
+		if len(row) != size {
+			return "", 0, false
+		}
+		for _, v := range row {
+			values = append(values, strconv.Itoa(int(math.Round(v*scale))))
+		}
+	}
+	return strings.Join(values, " "), 1 / (divisor * scale), true
+}
@@ -0,0 +1,251 @@
+package ffimage
+
+// JXLOptions is the encoder options for JPEG XL output.
+type JXLOptions struct {
+	// Distance is the butteraugli distance from 0.1 to 25, 1 is visually lossless. The distance will be calculated from SetQuality if 0 is passed.
+	Distance float64
+	// Effort is the encoding effort from 1 (fastest) to 9 (smallest), 7 as default.
+	Effort int
+	// Lossless encodes the image losslessly, Distance and SetQuality will be ignored.
+	Lossless bool
+	// LosslessJPEG recompresses the JPEG source losslessly so the JPEG can be restored bit-exact, only works if there's no operation applied to the image and the output isn't the source. The metadata is removed before the recompression unless PreserveEXIF is called, so the restored JPEG doesn't contain it either.
+	//
+	// NOTE: Requires cjxl to be installed. WriteImage returns the error if "cjxl" command was not found, the source can't be recompressed losslessly or cjxl failed.
+	LosslessJPEG bool
+}
+
+// SetJXLOptions sets the encoder options for JPEG XL output.
+//
+// NOTE: The animated JPEG XL requires ffmpeg 7.1 or later (libjxl_anim encoder), only the first frame is kept with the older ffmpeg.
+func (i *Image) SetJXLOptions(opts JXLOptions) *Image {
+	i.Output.JXL = &opts
+	return i
+}
+
+// TIFFCompression
+type TIFFCompression string
+
+const (
+	TIFFCompressionNone     TIFFCompression = ""
+	TIFFCompressionRaw      TIFFCompression = "raw"
+	TIFFCompressionPackBits TIFFCompression = "packbits"
+	TIFFCompressionLZW      TIFFCompression = "lzw"
+	TIFFCompressionDeflate  TIFFCompression = "deflate"
+)
+
+// TIFFOptions is the encoder options for TIFF output.
+type TIFFOptions struct {
+	// Compression is the compression algorithm, packbits is used if it's TIFFCompressionNone.
+	Compression TIFFCompression
+}
+
+// SetTIFFOptions sets the encoder options for TIFF output.
+func (i *Image) SetTIFFOptions(opts TIFFOptions) *Image {
+	i.Output.TIFF = &opts
+	return i
+}
+
+// WebPPreset
+type WebPPreset string
+
+const (
+	WebPPresetNone    WebPPreset = ""
+	WebPPresetDefault WebPPreset = "default"
+	WebPPresetPicture WebPPreset = "picture"
+	WebPPresetPhoto   WebPPreset = "photo"
+	WebPPresetDrawing WebPPreset = "drawing"
+	WebPPresetIcon    WebPPreset = "icon"
+	WebPPresetText    WebPPreset = "text"
+)
+
+// WebPOptions is the encoder options for WebP output.
+type WebPOptions struct {
+	// Lossless encodes the image losslessly, SetQuality controls the compression effort instead of the quality.
+	Lossless bool
+	// NearLossless is the strength of the near-lossless preprocessing from 0 (disabled) to 100 (strongest), the image is encoded losslessly after the preprocessing.
+	//
+	// NOTE: Requires cwebp to be installed. The image is encoded losslessly if "cwebp" command was not found, WriteImage returns the error if cwebp failed.
+	NearLossless int
+	// Preset tunes the encoder for the type of the image (e.g. WebPPresetPhoto, WebPPresetText).
+	Preset WebPPreset
+	// Method is the compression method from 0 (fastest) to 6 (smallest), the default of the encoder (4) is used if nil is passed.
+	Method *int
+	// AlphaQuality is the quality of the alpha channel from 1 to 100, 100 as default.
+	//
+	// NOTE: Requires cwebp to be installed. The option is ignored if "cwebp" command was not found, WriteImage returns the error if cwebp failed.
+	AlphaQuality int
+}
+
+// SetWebPOptions sets the encoder options for WebP output.
+func (i *Image) SetWebPOptions(opts WebPOptions) *Image {
+	i.Output.WebP = &opts
+	return i
+}
+
+// AVIFEncoder
+type AVIFEncoder string
+
+const (
+	AVIFEncoderNone  AVIFEncoder = ""
+	AVIFEncoderAOM   AVIFEncoder = "libaom-av1"
+	AVIFEncoderSVT   AVIFEncoder = "libsvtav1"
+	AVIFEncoderRav1e AVIFEncoder = "librav1e"
+)
+
+// AVIFChroma
+type AVIFChroma string
+
+const (
+	AVIFChromaNone AVIFChroma = ""
+	AVIFChroma420  AVIFChroma = "420"
+	AVIFChroma444  AVIFChroma = "444"
+)
+
+// AVIFOptions is the encoder options for AVIF output.
+type AVIFOptions struct {
+	// Encoder is the preferred AV1 encoder, libaom-av1 as default. The other encoders are used in the order of libaom-av1, libsvtav1 and librav1e if it wasn't compiled in ffmpeg.
+	Encoder AVIFEncoder
+	// Speed is from 1 (slowest, smallest) to 10 (fastest), the default of the encoder is used if 0 is passed (libaom-av1 is very slow by default).
+	Speed int
+	// Chroma is the chroma subsampling, 420 as default. libsvtav1 only supports 420.
+	Chroma AVIFChroma
+	// BitDepth is 8 or 10, 8 as default. The image is processed in 16 bits per channel for 10, except the filters which only work in 8 bits (e.g. RedactRegions).
+	BitDepth int
+	// TileColumns and TileRows split the image into tiles (power of 2) for faster multi-threaded encoding and decoding.
+	TileColumns int
+	TileRows    int
+	// Lossless encodes the image losslessly with 444 chroma, SetQuality will be ignored. libsvtav1 doesn't support lossless so the other encoders are preferred.
+	//
+	// NOTE: The color is stored as YUV, the conversion from RGB might cause slight differences.
+	Lossless bool
+	// KeyframeInterval is the max frames between the keyframes of the animated AVIF, smaller interval makes seeking faster but the file larger.
+	KeyframeInterval int
+	// Timescale is the units per second of the animated AVIF, the default is derived from the frame delays of the source.
+	Timescale int
+}
+
+// SetAVIFOptions sets the encoder options for AVIF output.
+func (i *Image) SetAVIFOptions(opts AVIFOptions) *Image {
+	i.Output.AVIF = &opts
+	return i
+}
+
+// JPEGChroma
+type JPEGChroma string
+
+const (
+	JPEGChromaNone JPEGChroma = ""
+	JPEGChroma420  JPEGChroma = "420"
+	JPEGChroma422  JPEGChroma = "422"
+	JPEGChroma444  JPEGChroma = "444"
+)
+
+// JPEGOptions is the encoder options for JPEG output.
+type JPEGOptions struct {
+	// Chroma is the chroma subsampling, 420 as default. Use 444 to keep the colored text and the sharp edges (e.g. screenshots) from smearing.
+	Chroma JPEGChroma
+	// Progressive encodes the image as progressive JPEG, baseline as default.
+	//
+	// NOTE: Requires jpegtran to be installed. The image remains baseline if "jpegtran" command was not found, WriteImage returns the error if jpegtran failed.
+	Progressive bool
+	// Optimize optimizes the huffman tables losslessly for smaller size, the image is also made progressive with optimized scans if jpegtran is from mozjpeg.
+	//
+	// NOTE: Requires jpegtran to be installed. The option is ignored if "jpegtran" command was not found, WriteImage returns the error if jpegtran failed.
+	Optimize bool
+	// RestartInterval inserts the restart markers every N MCU rows, so a corrupted part of the image won't break the rest.
+	//
+	// NOTE: Requires jpegtran to be installed. The option is ignored if "jpegtran" command was not found, WriteImage returns the error if jpegtran failed.
+	RestartInterval int
+}
+
+// SetJPEGOptions sets the encoder options for JPEG output.
+func (i *Image) SetJPEGOptions(opts JPEGOptions) *Image {
+	i.Output.JPEG = &opts
+	return i
+}
+
+// PNGPrediction
+type PNGPrediction string
+
+const (
+	PNGPredictionNone  PNGPrediction = ""
+	PNGPredictionOff   PNGPrediction = "none"
+	PNGPredictionSub   PNGPrediction = "sub"
+	PNGPredictionUp    PNGPrediction = "up"
+	PNGPredictionAvg   PNGPrediction = "avg"
+	PNGPredictionPaeth PNGPrediction = "paeth"
+	PNGPredictionMixed PNGPrediction = "mixed"
+)
+
+// PNGOptions is the encoder options for PNG and APNG output.
+type PNGOptions struct {
+	// CompressionLevel is the zlib compression level from 1 (fastest) to 9 (smallest), the default of ffmpeg is used if 0 is passed.
+	CompressionLevel int
+	// Prediction is the prediction filter before the compression, "mixed" tries every filter per row for the smallest size but is slower.
+	Prediction PNGPrediction
+	// BitDepth is 8 or 16 bits per channel, 8 as default. The image is processed in 16 bits per channel for 16, except the filters which only work in 8 bits (e.g. RedactRegions).
+	BitDepth int
+	// Palette reduces the colors to the palette (pal8) with palettegen and paletteuse, BitDepth will be ignored.
+	Palette bool
+	// Colors is the max colors of the palette from 4 to 256, 256 as default.
+	Colors int
+	// Interlace encodes the image with Adam7 interlacing, so it can be displayed progressively while loading.
+	Interlace bool
+}
+
+// SetPNGOptions sets the encoder options for PNG and APNG output.
+func (i *Image) SetPNGOptions(opts PNGOptions) *Image {
+	i.Output.PNG = &opts
+	return i
+}
+
+// GIFStatsMode
+type GIFStatsMode string
+
+const (
+	GIFStatsModeNone   GIFStatsMode = ""
+	GIFStatsModeFull   GIFStatsMode = "full"
+	GIFStatsModeDiff   GIFStatsMode = "diff"
+	GIFStatsModeSingle GIFStatsMode = "single"
+)
+
+// GIFDither
+type GIFDither string
+
+const (
+	GIFDitherNone           GIFDither = ""
+	GIFDitherOff            GIFDither = "none"
+	GIFDitherBayer          GIFDither = "bayer"
+	GIFDitherFloydSteinberg GIFDither = "floyd_steinberg"
+	GIFDitherSierra2        GIFDither = "sierra2"
+	GIFDitherSierra24A      GIFDither = "sierra2_4a"
+	GIFDitherSierra3        GIFDither = "sierra3"
+)
+
+// GIFOptions is the palette options for GIF output.
+type GIFOptions struct {
+	// MaxColors is the max colors of the palette from 4 to 256, 256 as default.
+	MaxColors int
+	// StatsMode decides which pixels the palette is generated from.
+	//
+	// - GIFStatsModeFull: Every pixel of every frame, the default.
+	//
+	// - GIFStatsModeDiff: Only the pixels which differ from the previous frame, so the moving parts get more colors than the static background.
+	//
+	// - GIFStatsModeSingle: A new palette for every frame.
+	StatsMode GIFStatsMode
+	// Dither is the dithering algorithm, sierra2_4a as default. GIFDitherOff disables the dithering, which reduces the size but bands the gradients.
+	Dither GIFDither
+	// BayerScale is the scale of the bayer pattern from 1 (crosshatch more visible, smoother gradients) to 5 (less visible), 2 as default. Only used by GIFDitherBayer.
+	BayerScale int
+	// DiffRectangle only updates the changed rectangle of every frame, which is faster and reduces the noise from dithering on the static background.
+	DiffRectangle bool
+	// AlphaThreshold is from 1 to 255, the pixels with the alpha lower than the threshold become transparent, 128 as default.
+	AlphaThreshold int
+}
+
+// SetGIFOptions sets the palette options for GIF output.
+func (i *Image) SetGIFOptions(opts GIFOptions) *Image {
+	i.Output.GIF = &opts
+	return i
+}
@@ -0,0 +1,379 @@
+package ffimage
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"math"
+	"os"
+	"sort"
+)
+
+// Optimizer is the tool which optimized the output after SetQuality.
+type Optimizer string
+
+const (
+	OptimizerNone     Optimizer = ""
+	OptimizerPNGQuant Optimizer = "pngquant"
+	OptimizerGifsicle Optimizer = "gifsicle"
+	OptimizerBuiltin  Optimizer = "builtin"
+)
+
+// quantizePNG reduces the colors of the PNG to a palette with the median cut algorithm and Floyd-Steinberg dithering, the file is only replaced if it's smaller. The color count is from 2 to 256 by the quality.
+func quantizePNG(path string, quality int) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	src, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	if _, ok := src.(*image.Paletted); ok {
+		return false, nil
+	}
+	bounds := src.Bounds()
+	rgba := image.NewNRGBA(bounds)
+	draw.Draw(rgba, bounds, src, bounds.Min, draw.Src)
+
+	colors := max(2, min(256, int(math.Round(math.Pow(2, 1+7*float64(quality)/100)))))
+	dst := image.NewPaletted(bounds, medianCut(rgba, colors))
+	draw.FloydSteinberg.Draw(dst, bounds, rgba, bounds.Min)
+
+	buf := bytes.NewBuffer(nil)
+	if err := (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(buf, dst); err != nil {
+		return false, err
+	}
+	if buf.Len() >= len(data) {
+		return false, nil
+	}
+	return true, os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// colorBox is the colors of a box in the median cut, the colors are bucketed with 5 bits per channel.
+type colorBox []*colorBucket
+
+// colorBucket
+type colorBucket struct {
+	count int
+	sum   [4]int
+	mean  [4]float64
+}
+
+// medianCut returns the palette of the image with the given color count. The box with the largest squared error is split at the weighted median of its widest channel, so the colors that cover more pixels get more precise.
+func medianCut(img *image.NRGBA, colors int) color.Palette {
+	buckets := make(map[uint32]*colorBucket)
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			c := img.NRGBAAt(x, y)
+			// The color of the fully transparent pixels doesn't matter.
+			if c.A == 0 {
+				c = color.NRGBA{}
+			}
+			key := uint32(c.R>>3)<<15 | uint32(c.G>>3)<<10 | uint32(c.B>>3)<<5 | uint32(c.A>>3)
+			b, ok := buckets[key]
+			if !ok {
+				b = &colorBucket{}
+				buckets[key] = b
+			}
+			b.count++
+			b.sum[0] += int(c.R)
+			b.sum[1] += int(c.G)
+			b.sum[2] += int(c.B)
+			b.sum[3] += int(c.A)
+		}
+	}
+	box := make(colorBox, 0, len(buckets))
+	for _, b := range buckets {
+		for c := 0; c < 4; c++ {
+			b.mean[c] = float64(b.sum[c]) / float64(b.count)
+		}
+		box = append(box, b)
+	}
+	boxes := []colorBox{box}
+
+	for len(boxes) < colors {
+		best, channel, bestErr := -1, 0, 0.0
+		for k, v := range boxes {
+			if len(v) < 2 {
+				continue
+			}
+			if c, e := v.widestChannel(); e > bestErr {
+				best, channel, bestErr = k, c, e
+			}
+		}
+		if best == -1 {
+			break
+		}
+		a, b := boxes[best].split(channel)
+		boxes[best] = a
+		boxes = append(boxes, b)
+	}
+
+	palette := make(color.Palette, 0, len(boxes))
+	for _, v := range boxes {
+		palette = append(palette, v.average())
+	}
+	return palette
+}
+
+// widestChannel returns the channel with the largest squared error and the error.
+func (b colorBox) widestChannel() (channel int, err float64) {
+	for c := 0; c < 4; c++ {
+		var sum, count float64
+		for _, v := range b {
+			sum += v.mean[c] * float64(v.count)
+			count += float64(v.count)
+		}
+		mean := sum / count
+		var e float64
+		for _, v := range b {
+			e += (v.mean[c] - mean) * (v.mean[c] - mean) * float64(v.count)
+		}
+		if e > err {
+			channel, err = c, e
+		}
+	}
+	return
+}
+
+// split splits the box at the weighted median of the channel.
+func (b colorBox) split(channel int) (colorBox, colorBox) {
+	sort.Slice(b, func(i, j int) bool {
+		return b[i].mean[channel] < b[j].mean[channel]
+	})
+	var total int
+	for _, v := range b {
+		total += v.count
+	}
+	k, sum := 0, 0
+	for ; k < len(b)-1; k++ {
+		if sum += b[k].count; sum*2 >= total {
+			break
+		}
+	}
+	return b[: k+1 : k+1], b[k+1:]
+}
+
+// average returns the weighted average color of the box.
+func (b colorBox) average() color.Color {
+	var sum [4]int
+	var count int
+	for _, v := range b {
+		for c := 0; c < 4; c++ {
+			sum[c] += v.sum[c]
+		}
+		count += v.count
+	}
+	a := uint8(sum[3] / count)
+	if a < 8 {
+		return color.NRGBA{}
+	}
+	return color.NRGBA{R: uint8(sum[0] / count), G: uint8(sum[1] / count), B: uint8(sum[2] / count), A: a}
+}
+
+// optimizeGIF re-encodes the animated GIF so every frame only contains the changed area and the unchanged pixels become transparent, which makes LZW compress better. The pixels that differ from the displayed pixel less than the threshold by the quality are also treated as unchanged, then the frame is made lossy for LZW (see lossyLZW) with the same threshold. The file is only replaced if it's smaller.
+//
+// NOTE: The GIF is kept as is if any pixel turns from opaque to transparent between frames, since it can't be drawn without disposal.
+func optimizeGIF(path string, quality int) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	src, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	if len(src.Image) < 2 {
+		return false, nil
+	}
+	threshold := int(math.Max(0, float64(100-quality)) / 4)
+	bounds := image.Rect(0, 0, src.Config.Width, src.Config.Height)
+
+	// canvas is the composited frame of the source, displayed is the frame shown by the optimized GIF.
+	canvas, displayed := image.NewNRGBA(bounds), image.NewNRGBA(bounds)
+	dst := &gif.GIF{
+		Delay:           src.Delay,
+		LoopCount:       src.LoopCount,
+		Config:          src.Config,
+		BackgroundIndex: src.BackgroundIndex,
+	}
+	for k, frame := range src.Image {
+		var previous *image.NRGBA
+		if k < len(src.Disposal) && src.Disposal[k] == gif.DisposalPrevious {
+			previous = image.NewNRGBA(bounds)
+			copy(previous.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		out, ok := diffFrame(canvas, displayed, frame.Palette, threshold, k == 0)
+		if !ok {
+			return false, nil
+		}
+		if threshold > 0 {
+			lossyLZW(out, threshold)
+		}
+		draw.Draw(displayed, out.Bounds(), out, out.Bounds().Min, draw.Over)
+		dst.Image = append(dst.Image, out)
+		dst.Disposal = append(dst.Disposal, gif.DisposalNone)
+
+		if k < len(src.Disposal) {
+			switch src.Disposal[k] {
+			case gif.DisposalBackground:
+				draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+			case gif.DisposalPrevious:
+				canvas = previous
+			}
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := gif.EncodeAll(buf, dst); err != nil {
+		return false, err
+	}
+	if buf.Len() >= len(data) {
+		return false, nil
+	}
+	return true, os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// diffFrame returns the frame which only contains the bounding box of the changed pixels between the canvas and the displayed frame, the unchanged pixels are transparent. Returns false if a pixel turns transparent.
+func diffFrame(canvas, displayed *image.NRGBA, palette color.Palette, threshold int, isFirst bool) (*image.Paletted, bool) {
+	palette = append(color.Palette{}, palette...)
+	transparent := -1
+	for k, v := range palette {
+		if _, _, _, a := v.RGBA(); a == 0 {
+			transparent = k
+			break
+		}
+	}
+	if transparent == -1 {
+		if len(palette) == 256 {
+			return nil, false
+		}
+		transparent = len(palette)
+		palette = append(palette, color.NRGBA{})
+	}
+
+	rect := image.Rectangle{}
+	changed := make([]bool, len(canvas.Pix)/4)
+	for y := canvas.Rect.Min.Y; y < canvas.Rect.Max.Y; y++ {
+		for x := canvas.Rect.Min.X; x < canvas.Rect.Max.X; x++ {
+			c, d := canvas.NRGBAAt(x, y), displayed.NRGBAAt(x, y)
+			if c.A == 0 && d.A != 0 {
+				return nil, false
+			}
+			if c.A == 0 || (!isFirst && colorDistance(c, d) <= threshold) {
+				continue
+			}
+			changed[canvas.PixOffset(x, y)/4] = true
+			rect = rect.Union(image.Rect(x, y, x+1, y+1))
+		}
+	}
+	// The frame must contain at least one pixel.
+	if rect.Empty() {
+		rect = image.Rect(0, 0, 1, 1)
+	}
+	out := image.NewPaletted(rect, palette)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			if !changed[canvas.PixOffset(x, y)/4] {
+				out.SetColorIndex(x, y, uint8(transparent))
+				continue
+			}
+			out.Set(x, y, canvas.NRGBAAt(x, y))
+		}
+	}
+	return out, true
+}
+
+// lossyLZW replaces the pixels of the frame with the similar colors so the LZW strings get longer, the same way as the lossy LZW of gifsicle. The LZW dictionary of the encoder is simulated, the longest string in the dictionary whose colors differ from the pixels less than the threshold is used instead of the exact match. The transparent pixels are always matched exactly.
+func lossyLZW(img *image.Paletted, threshold int) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	if w == 0 || h == 0 {
+		return
+	}
+	// similar[a][b] reports whether the color b can be used for the color a.
+	similar := make([][]bool, len(img.Palette))
+	colors := make([]color.NRGBA, len(img.Palette))
+	for k, v := range img.Palette {
+		colors[k] = color.NRGBAModel.Convert(v).(color.NRGBA)
+	}
+	for a := range colors {
+		similar[a] = make([]bool, len(colors))
+		for b := range colors {
+			if (colors[a].A == 0) != (colors[b].A == 0) {
+				continue
+			}
+			similar[a][b] = colors[a].A == 0 || colorDistance(colors[a], colors[b]) <= threshold
+		}
+	}
+	// The literal width is the same as image/gif, the first codes are the literals, the clear code and the end code.
+	litWidth := 2
+	for 1<<litWidth < len(img.Palette) {
+		litWidth++
+	}
+	first := 1<<litWidth + 2
+
+	pixels := make([]uint8, 0, w*h)
+	for y := 0; y < h; y++ {
+		pixels = append(pixels, img.Pix[y*img.Stride:y*img.Stride+w]...)
+	}
+	// children is the dictionary as a trie, the string of a code is its parent string with the pixel.
+	type entry struct {
+		code  int
+		pixel uint8
+	}
+	var children map[int][]entry
+	next := 0
+	reset := func() {
+		children = make(map[int][]entry)
+		next = first
+	}
+	reset()
+
+	for p := 0; p < len(pixels); {
+		// The string always starts with the exact literal.
+		code, n := int(pixels[p]), 1
+		for p+n < len(pixels) {
+			want, found, pixel := pixels[p+n], -1, uint8(0)
+			for _, v := range children[code] {
+				if v.pixel == want {
+					found, pixel = v.code, v.pixel
+					break
+				}
+				if found == -1 && similar[want][v.pixel] {
+					found, pixel = v.code, v.pixel
+				}
+			}
+			if found == -1 {
+				break
+			}
+			pixels[p+n] = pixel
+			code = found
+			n++
+		}
+		if p+n < len(pixels) {
+			children[code] = append(children[code], entry{code: next, pixel: pixels[p+n]})
+			if next++; next == 1<<12 {
+				reset()
+			}
+		}
+		p += n
+	}
+	for y := 0; y < h; y++ {
+		copy(img.Pix[y*img.Stride:y*img.Stride+w], pixels[y*w:(y+1)*w])
+	}
+}
+
+// colorDistance returns the largest difference of the channels.
+func colorDistance(a, b color.NRGBA) int {
+	d := 0
+	for _, v := range [][2]uint8{{a.R, b.R}, {a.G, b.G}, {a.B, b.B}, {a.A, b.A}} {
+		d = max(d, int(math.Abs(float64(v[0])-float64(v[1]))))
+	}
+	return d
+}
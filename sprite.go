@@ -0,0 +1,245 @@
+package ffimage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// Sprite is a single image placed on a sprite sheet.
+type Sprite struct {
+	Name   string `json:"name"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"w"`
+	Height int    `json:"h"`
+	// Duration is the display time of the frame in milliseconds, only available for the sheets from PackFrames.
+	Duration int `json:"duration,omitempty"`
+}
+
+// SpriteSheet is the manifest of a packed sprite sheet.
+type SpriteSheet struct {
+	Path    string    `json:"image"`
+	Width   int       `json:"width"`
+	Height  int       `json:"height"`
+	Sprites []*Sprite `json:"sprites"`
+}
+
+// PackSprites lays out multiple images into a single sprite sheet and writes it to the output path. The images are placed row by row with the given column count, the column count will be calculated automatically if 0 is passed. Only the first frame of animated images will be used. The sprites are named by the file names with the characters other than [A-Za-z0-9_-] replaced with "-", an index suffix is added if the name is already taken (e.g. "a/icon.png" and "b/icon.png" are "icon" and "icon-2").
+func PackSprites(paths []string, output string, columns int) (*SpriteSheet, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no images to pack")
+	}
+	if columns <= 0 {
+		columns = int(math.Ceil(math.Sqrt(float64(len(paths)))))
+	}
+	sheet := &SpriteSheet{
+		Path:    output,
+		Sprites: make([]*Sprite, 0, len(paths)),
+	}
+	var x, y, rowH int
+	names := make(map[string]bool, len(paths))
+
+	for k, path := range paths {
+		img, err := NewImage(path)
+		if err != nil {
+			return nil, fmt.Errorf("new image: %w", err)
+		}
+		if k != 0 && k%columns == 0 {
+			x = 0
+			y += rowH
+			rowH = 0
+		}
+		sheet.Sprites = append(sheet.Sprites, &Sprite{
+			Name:   spriteName(names, path),
+			X:      x,
+			Y:      y,
+			Width:  img.Width,
+			Height: img.Height,
+		})
+		x += img.Width
+		rowH = max(rowH, img.Height)
+		sheet.Width = max(sheet.Width, x)
+	}
+	sheet.Height = y + rowH
+
+	// Use a transparent canvas as the base and overlay every image to its own position.
+	canvas := ffmpeg.Input(fmt.Sprintf("color=c=black@0.0:s=%dx%d", sheet.Width, sheet.Height), ffmpeg.KwArgs{"f": "lavfi"}).
+		Filter("format", ffmpeg.Args{"rgba"})
+
+	for k, v := range sheet.Sprites {
+		sprite := ffmpeg.Input(paths[k]).Filter("format", ffmpeg.Args{"rgba"})
+		canvas = canvas.Overlay(sprite, "", ffmpeg.KwArgs{"x": v.X, "y": v.Y, "format": "auto"})
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := canvas.Output(output, ffmpeg.KwArgs{"frames:v": 1}).OverWriteOutput().Silent(true).WithErrorOutput(buf).Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg output: %s", buf.String())
+	}
+	return sheet, nil
+}
+
+// spriteName returns the unique name of the sprite from the file name of the path, the characters other than [A-Za-z0-9_-] are replaced with "-" and an index suffix is added if the name is already in the names.
+func spriteName(names map[string]bool, path string) string {
+	base := strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return '-'
+	}, strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+	name := base
+	for k := 2; names[name]; k++ {
+		name = fmt.Sprintf("%s-%d", base, k)
+	}
+	names[name] = true
+	return name
+}
+
+// PackFrames lays out the frames of an animated image into a single sprite sheet and writes it to the output path. The frame durations will be stored in the manifest. The column count will be calculated automatically if 0 is passed.
+func PackFrames(path string, output string, columns int) (*SpriteSheet, error) {
+	img, err := NewImage(path)
+	if err != nil {
+		return nil, fmt.Errorf("new image: %w", err)
+	}
+	durations, err := probeFrameDurations(path)
+	if err != nil {
+		return nil, fmt.Errorf("probe frame durations: %w", err)
+	}
+	frames := len(durations)
+	if frames == 0 {
+		return nil, fmt.Errorf("no frames found")
+	}
+	if columns <= 0 {
+		columns = int(math.Ceil(math.Sqrt(float64(frames))))
+	}
+	columns = min(columns, frames)
+	rows := int(math.Ceil(float64(frames) / float64(columns)))
+
+	sheet := &SpriteSheet{
+		Path:    output,
+		Width:   img.Width * columns,
+		Height:  img.Height * rows,
+		Sprites: make([]*Sprite, 0, frames),
+	}
+	for k, v := range durations {
+		sheet.Sprites = append(sheet.Sprites, &Sprite{
+			Name:     fmt.Sprintf("frame-%d", k),
+			X:        (k % columns) * img.Width,
+			Y:        (k / columns) * img.Height,
+			Width:    img.Width,
+			Height:   img.Height,
+			Duration: v,
+		})
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = ffmpeg.Input(path).
+		Filter("format", ffmpeg.Args{"rgba"}).
+		Filter("tile", ffmpeg.Args{fmt.Sprintf("layout=%dx%d:color=black@0.0", columns, rows)}).
+		Output(output, ffmpeg.KwArgs{"frames:v": 1}).OverWriteOutput().Silent(true).WithErrorOutput(buf).Run()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg output: %s", buf.String())
+	}
+	return sheet, nil
+}
+
+// JSON returns the manifest of the sprite sheet as JSON.
+func (s *SpriteSheet) JSON() ([]byte, error) {
+	return json.MarshalIndent(s, "", "  ")
+}
+
+// CSS returns the manifest of the sprite sheet as CSS classes, every sprite will be named as ".{prefix}-{name}". The class names and the image URL are escaped for CSS.
+func (s *SpriteSheet) CSS(prefix string) string {
+	var b strings.Builder
+	for _, v := range s.Sprites {
+		fmt.Fprintf(&b, ".%s {\n", cssIdent(prefix+"-"+v.Name))
+		fmt.Fprintf(&b, "  background: url(%s) -%dpx -%dpx no-repeat;\n", cssString(filepath.Base(s.Path)), v.X, v.Y)
+		fmt.Fprintf(&b, "  width: %dpx;\n", v.Width)
+		fmt.Fprintf(&b, "  height: %dpx;\n", v.Height)
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+// cssIdent escapes the string as a CSS identifier, the characters other than [A-Za-z0-9_-] and the leading digit are escaped as the code point.
+func cssIdent(s string) string {
+	var b strings.Builder
+	for k, r := range s {
+		isDigit := r >= '0' && r <= '9'
+		switch {
+		case r == 0:
+			b.WriteString("\uFFFD")
+		case isDigit && (k == 0 || (k == 1 && s[0] == '-')):
+			fmt.Fprintf(&b, "\\%x ", r)
+		case k == 0 && r == '-' && len(s) == 1:
+			b.WriteString("\\-")
+		case isDigit || r == '-' || r == '_' || r >= 0x80 || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z'):
+			b.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, "\\%x ", r)
+		default:
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// cssString quotes the string as a CSS string, the quote and the backslash are escaped and the control characters are escaped as the code point.
+func cssString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == 0:
+			b.WriteString("\uFFFD")
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, "\\%x ", r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// probeFrameDurations returns the duration of every frame in milliseconds.
+func probeFrameDurations(path string) ([]int, error) {
+	b, err := exec.Command("ffprobe", "-v", "quiet", "-print_format", "json", "-select_streams", "v:0", "-show_entries", "frame=duration_time,pkt_duration_time", path).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe: %w", err)
+	}
+	var data struct {
+		Frames []struct {
+			DurationTime    string `json:"duration_time"`
+			PktDurationTime string `json:"pkt_duration_time"`
+		} `json:"frames"`
+	}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	durations := make([]int, 0, len(data.Frames))
+	for _, v := range data.Frames {
+		// Newer ffprobe renamed "pkt_duration_time" to "duration_time".
+		t := v.DurationTime
+		if t == "" {
+			t = v.PktDurationTime
+		}
+		sec, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			sec = 0
+		}
+		durations = append(durations, int(math.Round(sec*1000)))
+	}
+	return durations, nil
+}
@@ -0,0 +1,151 @@
+package ffimage
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// tileGrid is the layout of the image which is stored as multiple tiles (e.g. HEIC from iPhone).
+type tileGrid struct {
+	codedWidth  int
+	codedHeight int
+	x           int
+	y           int
+	width       int
+	height      int
+	// rotation is the clockwise degrees to display the image (irot).
+	rotation   int
+	isMirrored bool
+	tiles      []*tile
+}
+
+// tile
+type tile struct {
+	index int
+	x     int
+	y     int
+}
+
+// probeTileGrid probes the tile grid stream group of the image, returns nil if the image isn't a tile grid.
+func probeTileGrid(path string) (*tileGrid, error) {
+	b, err := exec.Command("ffprobe", "-v", "quiet", "-print_format", "json", "-show_stream_groups", path).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe: %w", err)
+	}
+	var data struct {
+		StreamGroups []struct {
+			Type       string `json:"type"`
+			Components []struct {
+				CodedWidth       int `json:"coded_width"`
+				CodedHeight      int `json:"coded_height"`
+				HorizontalOffset int `json:"horizontal_offset"`
+				VerticalOffset   int `json:"vertical_offset"`
+				Width            int `json:"width"`
+				Height           int `json:"height"`
+				SideDataList     []struct {
+					SideDataType  string  `json:"side_data_type"`
+					DisplayMatrix string  `json:"displaymatrix"`
+					Rotation      float64 `json:"rotation"`
+				} `json:"side_data_list"`
+				Subcomponents []struct {
+					StreamIndex          int `json:"stream_index"`
+					TileHorizontalOffset int `json:"tile_horizontal_offset"`
+					TileVerticalOffset   int `json:"tile_vertical_offset"`
+				} `json:"subcomponents"`
+			} `json:"components"`
+		} `json:"stream_groups"`
+	}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	for _, g := range data.StreamGroups {
+		if !strings.EqualFold(g.Type, "tile grid") || len(g.Components) == 0 {
+			continue
+		}
+		c := g.Components[0]
+		grid := &tileGrid{
+			codedWidth:  c.CodedWidth,
+			codedHeight: c.CodedHeight,
+			x:           c.HorizontalOffset,
+			y:           c.VerticalOffset,
+			width:       c.Width,
+			height:      c.Height,
+		}
+		for _, v := range c.SideDataList {
+			if v.SideDataType != "Display Matrix" {
+				continue
+			}
+			// The rotation from ffprobe is counterclockwise.
+			grid.rotation = ((-int(math.Round(v.Rotation)) % 360) + 360) % 360
+			grid.isMirrored = isMirroredMatrix(v.DisplayMatrix)
+		}
+		for _, v := range c.Subcomponents {
+			grid.tiles = append(grid.tiles, &tile{index: v.StreamIndex, x: v.TileHorizontalOffset, y: v.TileVerticalOffset})
+		}
+		if len(grid.tiles) == 0 || grid.width == 0 || grid.height == 0 {
+			continue
+		}
+		return grid, nil
+	}
+	return nil, nil
+}
+
+// isMirroredMatrix reports whether the display matrix from ffprobe (e.g. "00000000: 0 65536 0\n00000001: -65536 0 0\n...") flips the image (imir).
+func isMirroredMatrix(matrix string) bool {
+	var m []float64
+	for _, line := range strings.Split(matrix, "\n") {
+		_, values, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		for _, v := range strings.Fields(values) {
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return false
+			}
+			m = append(m, n)
+		}
+	}
+	if len(m) < 5 {
+		return false
+	}
+	// The determinant of the 2x2 rotation part is negative if the image is flipped.
+	return m[0]*m[4]-m[1]*m[3] < 0
+}
+
+// size returns the displayed size of the image.
+func (g *tileGrid) size() (w, h int) {
+	if g.rotation == 90 || g.rotation == 270 {
+		return g.height, g.width
+	}
+	return g.width, g.height
+}
+
+// build stitches the tiles of the input to a single stream, then crops and orients it.
+func (g *tileGrid) build(input *ffmpeg.Stream) *ffmpeg.Stream {
+	canvas := ffmpeg.Input(fmt.Sprintf("color=c=black:s=%dx%d", g.codedWidth, g.codedHeight), ffmpeg.KwArgs{"f": "lavfi"})
+
+	for _, v := range g.tiles {
+		canvas = canvas.Overlay(input.Get(strconv.Itoa(v.index)), "", ffmpeg.KwArgs{"x": v.x, "y": v.y, "shortest": 1})
+	}
+	canvas = canvas.Filter("crop", ffmpeg.Args{fmt.Sprintf("%d:%d:%d:%d", g.width, g.height, g.x, g.y)})
+
+	switch g.rotation {
+	case 90:
+		canvas = canvas.Filter("transpose", ffmpeg.Args{"clock"})
+	case 180:
+		canvas = canvas.Filter("hflip", ffmpeg.Args{}).Filter("vflip", ffmpeg.Args{})
+	case 270:
+		canvas = canvas.Filter("transpose", ffmpeg.Args{"cclock"})
+	}
+	if g.isMirrored {
+		canvas = canvas.Filter("hflip", ffmpeg.Args{})
+	}
+	return canvas
+}
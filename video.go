@@ -0,0 +1,129 @@
+package ffimage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+const (
+	// blackMinDuration is the minimum seconds of the black interval for blackdetect (d), 0 reports even a single black frame.
+	blackMinDuration = 0
+	// blackPictureRatio is the minimum ratio of the black pixels for a frame to be black (pic_th), slightly lower than 1 so the noise or a small logo is allowed.
+	blackPictureRatio = 0.98
+	// blackPixelThreshold is the luminance from 0 to 1 under which a pixel is black (pix_th).
+	blackPixelThreshold = 0.10
+	// blackAnalysisDuration is the length from the beginning of the input which is analyzed for the black frames, the fade-in is usually much shorter.
+	blackAnalysisDuration = 10 * time.Second
+)
+
+// blackdetectRegexp matches the log of the blackdetect filter, e.g. "black_start:0 black_end:2.04 black_duration:2.04".
+var blackdetectRegexp = regexp.MustCompile(`black_start:\s*([\d.]+)\s+black_end:\s*([\d.]+)`)
+
+// NewImageFromVideo creates the image from the frame of the video (or any animated image) at the given time, the frame is used as a still image (e.g. poster, thumbnail).
+func NewImageFromVideo(path string, at time.Duration) (*Image, error) {
+	img, err := NewImage(path)
+	if err != nil {
+		return nil, fmt.Errorf("new image: %w", err)
+	}
+	if err := img.SelectFrame(at).err; err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// SelectFrame selects the frame of the video (or any animated image) at the given time, the frame is used as a still image. WriteImage returns the error if the time is longer than the duration.
+func (i *Image) SelectFrame(at time.Duration) *Image {
+	if at < 0 {
+		at = 0
+	}
+	if duration := i.getDuration(); duration > 0 && at > duration {
+		i.err = fmt.Errorf("select frame: %s is longer than the duration %s", at, duration)
+		return i
+	}
+	i.seek = at
+	i.DropFrames()
+	return i
+}
+
+// SelectBestFrame selects the most representative frame of the video (or any animated image) with the thumbnail filter, the black frames at the beginning (e.g. fade-in) are skipped with the blackdetect filter. The frame is used as a still image.
+//
+// NOTE: The function should be called before the other operations, since the thumbnail filter is applied in order with them. The frame is picked from the first "frames" (100 as default if 0 is passed) frames after the black frames. Only the first 10 seconds are analyzed for the black frames.
+func (i *Image) SelectBestFrame(frames int) *Image {
+	if frames <= 0 {
+		frames = 100
+	}
+	args := ffmpeg.KwArgs{"t": fmt.Sprintf("%.3f", blackAnalysisDuration.Seconds())}
+	for k, v := range i.inputArgs {
+		args[k] = v
+	}
+	out := ffmpeg.Input(i.Path, args).
+		Filter("blackdetect", ffmpeg.Args{fmt.Sprintf("d=%d:pic_th=%.2f:pix_th=%.2f", blackMinDuration, blackPictureRatio, blackPixelThreshold)}).
+		Output("-", ffmpeg.KwArgs{"f": "null", "an": ""})
+
+	// ffmpeg is stopped once the first black interval is logged, since the frames after it don't matter.
+	ctx, cancel := context.WithCancel(out.Context)
+	defer cancel()
+	out.Context = ctx
+	w := &blackdetectWriter{stop: cancel}
+
+	if err := out.Silent(i.Silent).WithInput(i.stdin()).WithErrorOutput(w).Run(); err != nil && ctx.Err() == nil {
+		i.err = fmt.Errorf("select best frame: %s", w.buf.String())
+		return i
+	}
+	i.seek = skipBlackFrames(w.buf.String())
+	// Use the beginning if the whole video is black.
+	if duration := i.getDuration(); duration > 0 && i.seek >= duration {
+		i.seek = 0
+	}
+	i.addFilter("thumbnail", ffmpeg.Args{fmt.Sprintf("n=%d", frames)})
+	i.DropFrames()
+	return i
+}
+
+// blackdetectWriter collects the log of the blackdetect filter and calls stop once a complete line of the black interval is written.
+type blackdetectWriter struct {
+	buf  bytes.Buffer
+	stop func()
+}
+
+// Write
+func (w *blackdetectWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	b := w.buf.Bytes()
+	if k := bytes.LastIndexByte(b, '\n'); k != -1 && blackdetectRegexp.Match(b[:k]) {
+		w.stop()
+	}
+	return len(p), nil
+}
+
+// skipBlackFrames returns the first time which isn't in the black intervals from the log of the blackdetect filter.
+func skipBlackFrames(log string) time.Duration {
+	var at float64
+	for _, v := range blackdetectRegexp.FindAllStringSubmatch(log, -1) {
+		start, err := strconv.ParseFloat(v[1], 64)
+		if err != nil || start > at {
+			break
+		}
+		end, err := strconv.ParseFloat(v[2], 64)
+		if err != nil {
+			break
+		}
+		at = max(at, end)
+	}
+	return time.Duration(at * float64(time.Second))
+}
+
+// getDuration returns the duration of the stream, returns 0 if it's unknown.
+func (i *Image) getDuration() time.Duration {
+	sec, err := strconv.ParseFloat(i.Stream.Duration, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(sec * float64(time.Second))
+}